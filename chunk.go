@@ -0,0 +1,180 @@
+package luna
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+// CompiledChunk is a chunk of Lua code precompiled to bytecode with Compile.
+// It can be run any number of times, by any Luna, without parsing the source
+// again.
+type CompiledChunk struct {
+	Name string
+	code []byte
+	// l is the Luna that compiled the chunk, which Run uses
+	l *Luna
+}
+
+// Bytes returns the chunk's Lua bytecode.
+func (c *CompiledChunk) Bytes() []byte {
+	return c.code
+}
+
+// Compile compiles src to bytecode without running it. <name> is used in error
+// messages, like a file name.
+func (l *Luna) Compile(name, src string) (c *CompiledChunk, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		if err = l.checkSourceLen(src); err != nil {
+			return
+		}
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+
+		if err = l.loadBuffer([]byte(src), name); err != nil {
+			return
+		}
+		if l.L.Dump() != 0 {
+			err = fmt.Errorf("Error dumping chunk: %s", name)
+			return
+		}
+		c = &CompiledChunk{Name: name, code: []byte(l.L.ToString(-1)), l: l}
+	})
+	return
+}
+
+// Run runs a compiled chunk with args, which it can get with `...`, and
+// returns its return values. Any globals it defines, such as functions, can be
+// used by later calls. The bytecode is only loaded the first time a chunk is
+// run; after that, the loaded function is kept for as long as the Luna.
+func (l *Luna) Run(c *CompiledChunk, args ...interface{}) (ret LuaRet, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() { ret, err = l.run(c, args...) })
+	return
+}
+
+// Run runs the chunk with args on the Luna that compiled it, like Luna.Run.
+func (c *CompiledChunk) Run(args ...interface{}) (LuaRet, error) {
+	return c.l.Run(c, args...)
+}
+
+// RunAndCall runs a compiled chunk, then calls the function <name> it defines
+// with args, returning that function's return values. This is the same as Run
+// followed by Call, but without another call running in between.
+func (l *Luna) RunAndCall(c *CompiledChunk, name string, args ...interface{}) (LuaRet, error) {
+	defer l.lock()()
+	if err := l.ready(); err != nil {
+		return nil, err
+	}
+	var err error
+	l.do(func() { _, err = l.run(c) })
+	if err != nil {
+		return nil, err
+	}
+	return l.callSync(name, args...)
+}
+
+func (l *Luna) run(c *CompiledChunk, args ...interface{}) (LuaRet, error) {
+	base := l.L.GetTop()
+	if ref, ok := l.chunks[c]; ok {
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+	} else {
+		if err := l.loadBuffer(c.code, c.Name); err != nil {
+			return nil, err
+		}
+		l.L.PushValue(-1)
+		l.chunks[c] = l.L.Ref(lua.LUA_REGISTRYINDEX)
+	}
+	if err := l.invokeTop(args...); err != nil {
+		return nil, err
+	}
+	return l.getReturnValues(base)
+}
+
+// loadBuffer loads code, either source or bytecode, as a chunk named <name>,
+// leaving its function on the stack.
+func (l *Luna) loadBuffer(code []byte, name string) error {
+	// a leading '=' tells Lua to use the name as-is in messages, and '@' that
+	// it's a file name, which is used as-is too
+	if !strings.HasPrefix(name, "@") {
+		name = "=" + name
+	}
+	if l.L.LoadBuffer(code, len(code), name) != 0 {
+		err := newLunaError(l.L.ToString(-1))
+		l.L.Pop(1)
+		return err
+	}
+	return nil
+}
+
+// Dump compiles src and returns its bytecode, which can be run with
+// LoadBytecode, by this or another Luna, without parsing it again.
+func (l *Luna) Dump(src string) ([]byte, error) {
+	c, err := l.Compile("bytecode", src)
+	if err != nil {
+		return nil, err
+	}
+	return c.Bytes(), nil
+}
+
+// LoadBytecode runs bytecode created by Dump or Compile and returns its return
+// values. An error is returned if it was made by a different version of Lua,
+// or on a platform with different sizes of numbers, which Lua can't load.
+// Only load bytecode from trusted sources, since Lua doesn't verify it and
+// malicious bytecode can crash the process.
+func (l *Luna) LoadBytecode(b []byte) (ret LuaRet, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		if err = l.checkHeader(b); err != nil {
+			return
+		}
+		base := l.L.GetTop()
+		if err = l.loadBuffer(b, "bytecode"); err != nil {
+			return
+		}
+		if err = l.invokeTop(); err == nil {
+			ret, err = l.getReturnValues(base)
+		}
+	})
+	return
+}
+
+// headerSize is the size of the header of Lua 5.1 bytecode: the signature
+// "\x1bLua", the version, the format, the byte order and the sizes of the
+// types used.
+const headerSize = 12
+
+// checkHeader returns an error if the header of the bytecode b doesn't match
+// the bytecode created by this Lua.
+func (l *Luna) checkHeader(b []byte) error {
+	if l.header == nil {
+		top := l.L.GetTop()
+		l.L.LoadString("")
+		l.L.Dump()
+		l.header = []byte(l.L.ToString(-1))[:headerSize]
+		l.L.SetTop(top)
+	}
+
+	if len(b) < headerSize || !bytes.HasPrefix(b, l.header[:4]) {
+		return fmt.Errorf("Not Lua bytecode")
+	}
+	if b[4] != l.header[4] {
+		return fmt.Errorf("Bytecode is for Lua %d.%d, not %d.%d", b[4]>>4, b[4]&0xf, l.header[4]>>4, l.header[4]&0xf)
+	}
+	if !bytes.Equal(b[:headerSize], l.header) {
+		return fmt.Errorf("Bytecode was compiled for a different platform")
+	}
+	return nil
+}
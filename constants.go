@@ -0,0 +1,102 @@
+package luna
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+// ConstantOptions control the table created by SetConstants.
+type ConstantOptions struct {
+	// Reverse, if set, is the key of a sub-table mapping each value back to
+	// the name of its constant, so scripts can turn enum values into names.
+	Reverse string
+}
+
+// SetConstants sets the global <name> to a read-only table of consts, like
+// the values of an enum:
+//
+//	l.SetConstants("Status", map[string]interface{}{"OK": 200, "NotFound": 404},
+//		ConstantOptions{Reverse: "names"})
+//
+// lets scripts use Status.OK, and Status.names[404] to get "NotFound".
+// Assigning to either table raises an error. Since the tables are empty
+// proxies for the real ones, pairs() can't be used to iterate over them. An
+// error is returned if two constants have the same value when Reverse is set.
+func (l *Luna) SetConstants(name string, consts map[string]interface{}, opts ConstantOptions) (err error) {
+	if _, ok := consts[opts.Reverse]; ok && opts.Reverse != "" {
+		return fmt.Errorf("Constant %s conflicts with the reverse table", opts.Reverse)
+	}
+	names := make([]string, 0, len(consts))
+	for k := range consts {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+
+		l.L.NewTable()
+		for _, k := range names {
+			if err = l.push(consts[k]); err != nil {
+				return
+			}
+			l.L.SetField(-2, k)
+		}
+
+		if opts.Reverse != "" {
+			l.L.NewTable()
+			for _, k := range names {
+				l.L.GetField(-2, k)
+				if l.L.IsNil(-1) {
+					// nil can't be a key
+					l.L.Pop(1)
+					continue
+				}
+				l.L.PushValue(-1)
+				l.L.RawGet(-3)
+				if !l.L.IsNil(-1) {
+					err = fmt.Errorf("Constants %s and %s have the same value", l.L.ToString(-1), k)
+					return
+				}
+				l.L.Pop(1)
+				l.L.PushString(k)
+				l.L.RawSet(-3)
+			}
+			l.readOnly()
+			l.L.SetField(-2, opts.Reverse)
+		}
+
+		l.readOnly()
+		l.setGlobal(nil, name)
+	})
+	return
+}
+
+// readOnly replaces the table on top of the stack with an empty proxy whose
+// metatable looks keys up in the table and refuses assignments.
+func (l *Luna) readOnly() {
+	l.L.NewTable()
+	l.L.NewTable()
+	l.L.PushValue(-3)
+	l.L.SetField(-2, "__index")
+	l.L.PushGoFunction(readOnlyNewIndex)
+	l.L.SetField(-2, "__newindex")
+	// keeps setmetatable() from removing the protection
+	l.L.PushBoolean(false)
+	l.L.SetField(-2, "__metatable")
+	l.L.SetMetaTable(-2)
+	l.L.Remove(-2)
+}
+
+// readOnlyNewIndex is the __newindex metamethod of tables made by readOnly.
+func readOnlyNewIndex(L *lua.State) int {
+	L.RaiseError(fmt.Sprintf("Cannot assign to constant '%s'", L.ToString(2)))
+	return 0
+}
@@ -0,0 +1,148 @@
+package luna
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+// coroutineSrc resumes a coroutine, returning whether it's finished followed
+// by the values it yielded or returned, or raising its error.
+const coroutineSrc = `
+local resume, status, error = coroutine.resume, coroutine.status, error
+return function(co, ...)
+	local function finish(ok, ...)
+		if not ok then
+			error((...), 0)
+		end
+		return status(co) == "dead", ...
+	end
+	return finish(resume(co, ...))
+end`
+
+// Coroutine is a Lua coroutine that runs a global function, which can be
+// resumed from Go until it finishes. Create one with NewCoroutine. It can also
+// be passed to Lua like any other value, as a Lua coroutine.
+type Coroutine struct {
+	l   *Luna
+	ref int
+}
+
+// NewCoroutine creates a coroutine that runs the global function <fn> when it's
+// first resumed. This requires LibBase.
+func (l *Luna) NewCoroutine(fn string) (co *Coroutine, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+
+		if l.resumer == 0 {
+			if l.L.LoadString(coroutineSrc) != 0 {
+				err = errors.New(l.L.ToString(-1))
+				return
+			}
+			if err = l.L.Call(0, 1); err != nil {
+				return
+			}
+			l.resumer = l.L.Ref(lua.LUA_REGISTRYINDEX)
+		}
+
+		l.L.GetGlobal("coroutine")
+		l.L.GetField(-1, "create")
+		l.L.GetGlobal(fn)
+		if !l.L.IsFunction(-1) {
+			err = fmt.Errorf("Not a function: %s", fn)
+			return
+		}
+		if err = l.L.Call(1, 1); err != nil {
+			return
+		}
+		co = &Coroutine{l: l, ref: l.L.Ref(lua.LUA_REGISTRYINDEX)}
+	})
+	return
+}
+
+// Resume runs the coroutine until it yields or returns, passing args to the
+// function the first time, and as the results of coroutine.yield() after
+// that. It returns the values passed to yield, or returned by the function,
+// and whether the coroutine has finished. A coroutine that raised an error is
+// finished, and can't be resumed again. CallTimeout is not used.
+func (co *Coroutine) Resume(args ...interface{}) (ret LuaRet, done bool, err error) {
+	l := co.l
+	if !l.onWorker() {
+		if err = l.blocked(); err != nil {
+			return
+		}
+	}
+
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		base := l.L.GetTop()
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, l.resumer)
+		if err = l.invokeTop(append([]interface{}{co}, args...)...); err != nil {
+			done = true
+			return
+		}
+		done = l.L.ToBoolean(base + 1)
+		l.L.Remove(base + 1)
+		ret, err = l.getReturnValues(base)
+	})
+	return
+}
+
+// Release frees the coroutine, which can't be resumed afterwards.
+func (co *Coroutine) Release() {
+	l := co.l
+	defer l.lock()()
+	if l.ready() != nil || co.ref == 0 {
+		return
+	}
+	l.do(func() { l.L.Unref(lua.LUA_REGISTRYINDEX, co.ref) })
+	co.ref = 0
+}
+
+// StreamCoroutine runs the global function <name> as a coroutine with args,
+// sending the values of each yield, and then any values it returns, on the
+// first channel. If it fails, the error is sent on the second channel. Both
+// channels are closed when the coroutine finishes. The coroutine is only
+// resumed once the previous values are received, so the caller must drain the
+// first channel, or the coroutine is never released.
+func (l *Luna) StreamCoroutine(name string, args ...interface{}) (<-chan LuaRet, <-chan error) {
+	vals := make(chan LuaRet)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(vals)
+
+		co, err := l.NewCoroutine(name)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer co.Release()
+		for {
+			ret, done, err := co.Resume(args...)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if done && len(ret) == 0 {
+				return
+			}
+			vals <- ret
+			if done {
+				return
+			}
+			// yield() gets no values back
+			args = nil
+		}
+	}()
+	return vals, errs
+}
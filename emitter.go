@@ -0,0 +1,138 @@
+package luna
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+// emitterSrc creates the Lua side of an Emitter.
+const emitterSrc = `
+local e = {callbacks = {}}
+function e:on(fn)
+	self.callbacks[#self.callbacks + 1] = fn
+end
+return e`
+
+// Emitter bridges values sent on a Go channel to Lua callbacks. Scripts
+// register callbacks with emitter:on(fn), and each value received from the
+// channel is passed to every callback when Pump is called.
+// An Emitter can be passed to Lua like any other value, e.g. as an argument
+// to Call. It's pumped, and its Lua object kept, until ch is closed or
+// Release is called.
+type Emitter struct {
+	l   *Luna
+	ch  chan interface{}
+	ref int
+}
+
+// PushEmitter creates an Emitter for ch. Values are only received from ch by
+// Pump, so callbacks always run on the Lua thread between other calls, and a
+// send on an unbuffered ch blocks until the next Pump. Once ch is closed, the
+// Emitter is no longer pumped.
+func (l *Luna) PushEmitter(ch chan interface{}) (e *Emitter, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+
+		if l.L.LoadString(emitterSrc) != 0 {
+			err = errors.New(l.L.ToString(-1))
+			return
+		}
+		if err = l.L.Call(0, 1); err != nil {
+			return
+		}
+		e = &Emitter{l: l, ch: ch, ref: l.L.Ref(lua.LUA_REGISTRYINDEX)}
+		l.emitters = append(l.emitters, e)
+	})
+	return
+}
+
+// Release stops pumping the emitter and drops the reference to its Lua
+// object, after which it can't be passed to Lua. Values still waiting on its
+// channel aren't delivered.
+func (e *Emitter) Release() {
+	l := e.l
+	defer l.lock()()
+	if l.ready() != nil || e.ref == 0 {
+		return
+	}
+	l.do(func() {
+		for i, other := range l.emitters {
+			if other == e {
+				l.emitters = append(l.emitters[:i], l.emitters[i+1:]...)
+				break
+			}
+		}
+		l.L.Unref(lua.LUA_REGISTRYINDEX, e.ref)
+	})
+	e.ref = 0
+}
+
+// Pump delivers all values waiting on the channels of every Emitter to the
+// callbacks registered for them. A failing callback doesn't stop the others
+// from running; all of their errors are returned together.
+func (l *Luna) Pump() error {
+	defer l.lock()()
+	if err := l.ready(); err != nil {
+		return err
+	}
+
+	var errs []error
+	l.do(func() {
+		open := l.emitters[:0]
+		for _, e := range l.emitters {
+			if l.drain(e, &errs) {
+				open = append(open, e)
+			} else {
+				l.L.Unref(lua.LUA_REGISTRYINDEX, e.ref)
+				e.ref = 0
+			}
+		}
+		l.emitters = open
+	})
+	return errors.Join(errs...)
+}
+
+// drain dispatches values from e's channel until it's empty, returning false
+// if it has been closed.
+func (l *Luna) drain(e *Emitter, errs *[]error) bool {
+	for {
+		select {
+		case val, ok := <-e.ch:
+			if !ok {
+				return false
+			}
+			*errs = append(*errs, l.emit(e, val)...)
+		default:
+			return true
+		}
+	}
+}
+
+// emit calls each of e's callbacks with val.
+func (l *Luna) emit(e *Emitter, val interface{}) (errs []error) {
+	top := l.L.GetTop()
+	defer l.L.SetTop(top)
+
+	l.L.RawGeti(lua.LUA_REGISTRYINDEX, e.ref)
+	l.L.GetField(-1, "callbacks")
+	callbacks := l.L.GetTop()
+	for i := 1; i <= int(l.L.ObjLen(callbacks)); i++ {
+		l.L.RawGeti(callbacks, i)
+		if err := l.push(val); err != nil {
+			l.L.Pop(1)
+			errs = append(errs, err)
+			continue
+		}
+		if err := l.pcall(1, 0); err != nil {
+			errs = append(errs, fmt.Errorf("Emitter callback %d: %w", i, err))
+		}
+	}
+	return
+}
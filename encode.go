@@ -0,0 +1,194 @@
+package luna
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Encode writes lv to w as Lua source that evaluates to the same value, so it
+// can be saved and loaded again later. Tables are written over multiple lines,
+// indented with tabs, with array elements first, followed by the other keys in
+// sorted order. LuaPointer and LuaError values can't be encoded.
+func Encode(w io.Writer, lv LuaValue) error {
+	e := &encoder{w: w, pretty: true}
+	e.value(lv, 0)
+	return e.err
+}
+
+// encoder writes Lua values as source. It's shared by Encode and String, which
+// sets pretty to false to get a compact, single line form instead.
+type encoder struct {
+	w      io.Writer
+	pretty bool
+	err    error
+}
+
+func (e *encoder) write(s string) {
+	if e.err == nil {
+		_, e.err = io.WriteString(e.w, s)
+	}
+}
+
+func (e *encoder) value(lv LuaValue, depth int) {
+	switch v := lv.(type) {
+	case nil, LuaNil:
+		e.write("nil")
+	case LuaBool:
+		e.write(v.String())
+	case LuaNumber:
+		e.write(e.number(float64(v)))
+	case LuaString:
+		e.write(quote(string(v)))
+	case LuaTable:
+		e.table(v, depth)
+	default:
+		if !e.pretty {
+			e.write(fmt.Sprint(lv))
+		} else if e.err == nil {
+			e.err = fmt.Errorf("Cannot encode %T as Lua source", lv)
+		}
+	}
+}
+
+// number formats f like tostring() does for String, or exactly for Encode.
+func (e *encoder) number(f float64) string {
+	if !e.pretty {
+		return LuaNumber(f).String()
+	}
+	switch {
+	case math.IsInf(f, 1):
+		return "1/0"
+	case math.IsInf(f, -1):
+		return "-1/0"
+	case math.IsNaN(f):
+		return "0/0"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (e *encoder) table(lv LuaTable, depth int) {
+	type entry struct {
+		key string
+		val LuaValue
+	}
+	var entries []entry
+
+	n := lv.RawLen()
+	for i := 1; i <= n; i++ {
+		entries = append(entries, entry{"", lv.indexed[float64(i)]})
+	}
+
+	var indexes []float64
+	for k := range lv.indexed {
+		if k < 1 || k > float64(n) || k != math.Trunc(k) {
+			indexes = append(indexes, k)
+		}
+	}
+	sort.Float64s(indexes)
+	for _, k := range indexes {
+		entries = append(entries, entry{"[" + e.number(k) + "]", lv.indexed[k]})
+	}
+
+	keys := make([]string, 0, len(lv.mapped))
+	for k := range lv.mapped {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := k
+		if !isIdentifier(k) {
+			key = "[" + quote(k) + "]"
+		}
+		entries = append(entries, entry{key, lv.mapped[k]})
+	}
+
+	for _, k := range []bool{false, true} {
+		if v, ok := lv.booled[k]; ok {
+			entries = append(entries, entry{"[" + strconv.FormatBool(k) + "]", v})
+		}
+	}
+
+	if len(entries) == 0 {
+		e.write("{}")
+		return
+	}
+	sep, assign := ", ", "="
+	if e.pretty {
+		sep, assign = "", " = "
+	}
+	e.write("{")
+	for i, ent := range entries {
+		if e.pretty {
+			e.write("\n" + strings.Repeat("\t", depth+1))
+		} else if i > 0 {
+			e.write(sep)
+		}
+		if ent.key != "" {
+			e.write(ent.key + assign)
+		}
+		e.value(ent.val, depth+1)
+		if e.pretty {
+			e.write(",")
+		}
+	}
+	if e.pretty {
+		e.write("\n" + strings.Repeat("\t", depth))
+	}
+	e.write("}")
+}
+
+// quote returns s as a Lua string literal. Unlike strconv.Quote, it only uses
+// escapes that Lua 5.1 understands.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < ' ' || c == 0x7f {
+				// always three digits, so a following digit isn't included
+				fmt.Fprintf(&b, "\\%03d", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+// isIdentifier reports whether s can be used as a table key without brackets.
+func isIdentifier(s string) bool {
+	if s == "" || luaKeywords[s] {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9' {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package luna
+
+import (
+	"sort"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+// Env is a table of globals that chunks can be run in instead of the real
+// globals (_G), which keeps scripts from seeing or changing each other's
+// globals. Create one with NewEnv, fill it with CreateLibraryIn and
+// SetGlobalIn, and run scripts in it with LoadIn.
+type Env struct {
+	ref int
+}
+
+// NewEnv creates an empty environment. If inherit is set, globals that aren't
+// set in the environment are read from the real globals, so scripts can still
+// use the standard libraries; assignments always go to the environment.
+func (l *Luna) NewEnv(inherit bool) (env *Env) {
+	defer l.lock()()
+	if l.ready() != nil {
+		return nil
+	}
+	l.do(func() {
+		l.L.NewTable()
+		if inherit {
+			l.L.NewTable()
+			l.L.PushValue(lua.LUA_GLOBALSINDEX)
+			l.L.SetField(-2, "__index")
+			l.L.SetMetaTable(-2)
+		}
+		env = &Env{l.L.Ref(lua.LUA_REGISTRYINDEX)}
+	})
+	return
+}
+
+// CreateLibraryIn is like CreateLibrary, but registers the library in env
+// instead of the real globals.
+func (l *Luna) CreateLibraryIn(env *Env, name string, members ...TableKeyValue) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() { err = l.createLibrary(env, name, nil, members) })
+	return
+}
+
+// SetGlobalIn sets the global <name> of env to val.
+func (l *Luna) SetGlobalIn(env *Env, name string, val interface{}) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+		if err = l.push(val); err == nil {
+			l.setGlobal(env, name)
+		}
+	})
+	return
+}
+
+// LoadIn is like Load, but runs src with env as its globals. Functions it
+// defines keep using env when they're called later.
+func (l *Luna) LoadIn(env *Env, src string) (ret LuaRet, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		base := l.L.GetTop()
+		if err = l.doString(env, "", src); err == nil {
+			ret, err = l.getReturnValues(base)
+		}
+	})
+	return
+}
+
+// trackingEnv returns the environment chunks are run in when TrackGlobals is
+// set, creating it the first time. It's always empty, so that every assignment
+// to a global goes through trackWrite to the real globals.
+func (l *Luna) trackingEnv() *Env {
+	if l.tracker != nil {
+		return l.tracker
+	}
+	l.L.NewTable()
+	l.L.NewTable()
+	l.L.PushValue(lua.LUA_GLOBALSINDEX)
+	l.L.SetField(-2, "__index")
+	l.L.PushGoFunction(l.trackWrite)
+	l.L.SetField(-2, "__newindex")
+	l.L.SetMetaTable(-2)
+	l.tracker = &Env{l.L.Ref(lua.LUA_REGISTRYINDEX)}
+	return l.tracker
+}
+
+// trackWrite is the __newindex metamethod of the tracking environment. It sets
+// the global, respecting FreezeGlobals, and records it while a Load is running.
+func (l *Luna) trackWrite(L *lua.State) int {
+	L.PushValue(2)
+	L.RawGet(lua.LUA_GLOBALSINDEX)
+	created := L.IsNil(-1)
+	L.Pop(1)
+
+	L.PushValue(2)
+	L.PushValue(3)
+	L.SetTable(lua.LUA_GLOBALSINDEX)
+
+	if l.tracking && L.Type(2) == lua.LUA_TSTRING {
+		name := L.ToString(2)
+		val, err := l.pop(3)
+		if err != nil {
+			L.RaiseError(err.Error())
+			return 0
+		}
+		l.lastWrites[name] = val
+		if created {
+			l.lastCreated[name] = true
+		}
+	}
+	return 0
+}
+
+// LastWrites returns the globals assigned by the last Load run with
+// TrackGlobals set, and the last values they were assigned. Assignments made
+// through _G aren't seen.
+func (l *Luna) LastWrites() map[string]LuaValue {
+	defer l.lock()()
+	writes := make(map[string]LuaValue, len(l.lastWrites))
+	for k, v := range l.lastWrites {
+		writes[k] = v
+	}
+	return writes
+}
+
+// LastCreated returns the sorted names of the globals in LastWrites that
+// didn't exist before they were assigned, as opposed to existing globals that
+// were changed.
+func (l *Luna) LastCreated() []string {
+	defer l.lock()()
+	var names []string
+	for k := range l.lastCreated {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
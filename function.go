@@ -0,0 +1,101 @@
+package luna
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+var luaFunctionType = reflect.TypeOf((*LuaFunction)(nil))
+
+// LuaFunction is a Lua function returned to Go, such as a callback, which can
+// be called later. It holds a reference that keeps the function from being
+// garbage collected by Lua until Release is called, or the LuaFunction itself
+// is garbage collected by Go.
+// A Go function called from Lua can take a *LuaFunction parameter to receive
+// a function argument.
+type LuaFunction struct {
+	l   *Luna
+	ref int
+}
+
+// newFunction wraps ref, a reference to a function in the registry. The
+// reference is released once the LuaFunction is garbage collected, if Release
+// wasn't called first.
+func (l *Luna) newFunction(ref int) *LuaFunction {
+	f := &LuaFunction{l: l, ref: ref}
+	runtime.SetFinalizer(f, (*LuaFunction).finalize)
+	return f
+}
+
+// finalize queues f's reference to be released by the worker, since the Lua
+// state can't be touched from the finalizer goroutine.
+func (f *LuaFunction) finalize() {
+	if f.ref != 0 {
+		f.l.queueUnref(f.ref)
+	}
+}
+
+// pushFunction pushes the function f refers to.
+func (l *Luna) pushFunction(f *LuaFunction) error {
+	if f.l != l || f.ref == 0 {
+		return fmt.Errorf("Function is released or from another Luna")
+	}
+	l.L.RawGeti(lua.LUA_REGISTRYINDEX, f.ref)
+	return nil
+}
+
+// Call calls the function with args, like Luna.Call, but without using
+// CallTimeout.
+func (f *LuaFunction) Call(args ...interface{}) (ret LuaRet, err error) {
+	l := f.l
+	if !l.onWorker() {
+		if err = l.blocked(); err != nil {
+			return
+		}
+	}
+
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		base := l.L.GetTop()
+		if err = l.pushFunction(f); err != nil {
+			return
+		}
+		if err = l.invokeTop(args...); err == nil {
+			ret, err = l.getReturnValues(base)
+		}
+	})
+	return
+}
+
+// Release drops the reference to the function, after which it can't be
+// called.
+func (f *LuaFunction) Release() {
+	l := f.l
+	defer l.lock()()
+	if l.ready() != nil || f.ref == 0 {
+		return
+	}
+	l.do(func() { l.L.Unref(lua.LUA_REGISTRYINDEX, f.ref) })
+	f.ref = 0
+	runtime.SetFinalizer(f, nil)
+}
+
+// Unmarshal sets d, which must be a **LuaFunction, to f.
+func (f *LuaFunction) Unmarshal(d interface{}) error {
+	dst, ok := d.(**LuaFunction)
+	if !ok {
+		return fmt.Errorf("Cannot assign Lua function to %T", d)
+	}
+	*dst = f
+	return nil
+}
+
+func (f *LuaFunction) String() string {
+	return fmt.Sprintf("function: %d", f.ref)
+}
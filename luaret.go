@@ -2,10 +2,35 @@ package luna
 
 import (
 	"fmt"
+	"reflect"
 )
 
 type LuaRet []LuaValue
 
+// Varargs is the type of the final parameter of a Go function called from Lua
+// that takes any number of arguments of any type. It receives the remaining
+// arguments unconverted, so the function can inspect their types:
+//
+//	func(name string, args luna.Varargs)
+//
+// A variadic parameter of type ...LuaValue works the same way.
+type Varargs []LuaValue
+
+var varargsType = reflect.TypeOf(Varargs(nil))
+
+// IsEmpty reports whether there are no values.
+func (lr LuaRet) IsEmpty() bool {
+	return len(lr) == 0
+}
+
+// First returns the first value, or LuaNil if there are none.
+func (lr LuaRet) First() LuaValue {
+	if lr.IsEmpty() {
+		return LuaNil(nil)
+	}
+	return lr[0]
+}
+
 func (lr LuaRet) Unmarshal(vals ...interface{}) error {
 	if len(vals) != len(lr) {
 		return fmt.Errorf("")
@@ -17,3 +42,36 @@ func (lr LuaRet) Unmarshal(vals ...interface{}) error {
 	}
 	return nil
 }
+
+// UnmarshalWith is like Unmarshal, but converts values according to opts.
+func (lr LuaRet) UnmarshalWith(opts UnmarshalOptions, vals ...interface{}) error {
+	if len(vals) != len(lr) {
+		return fmt.Errorf("Expected %d values, got %d", len(lr), len(vals))
+	}
+	for i, v := range vals {
+		if err := opts.Unmarshal(lr[i], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalSlice unmarshals all of the values into dst, which must be a pointer
+// to a slice. This is useful for functions returning a variable number of
+// values of the same type.
+func (lr LuaRet) UnmarshalSlice(dst interface{}) error {
+	destVal := reflect.ValueOf(dst)
+	if destVal.Kind() != reflect.Ptr || destVal.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("Must pass a pointer to a slice to UnmarshalSlice")
+	}
+	destVal = destVal.Elem()
+
+	slice := reflect.MakeSlice(destVal.Type(), len(lr), len(lr))
+	for i, v := range lr {
+		if err := v.Unmarshal(slice.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	destVal.Set(slice)
+	return nil
+}
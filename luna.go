@@ -1,11 +1,20 @@
 package luna
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/beatgammit/golua/lua"
@@ -17,6 +26,128 @@ func (t Timeout) Error() string {
 	return "Timeout calling function: " + string(t)
 }
 
+// hookCount is the number of VM instructions executed between checks for
+// whether the running chunk should be interrupted.
+const hookCount = 1000
+
+// timeoutGrace is how long Call waits for a timed out chunk to be interrupted
+// before leaving it running in the background.
+const timeoutGrace = 10 * time.Millisecond
+
+// DefaultMaxPushDepth is the nesting limit used when pushing values if
+// Luna.MaxPushDepth is zero.
+const DefaultMaxPushDepth = 1000
+
+// MaxDepthExceeded is returned when a value being pushed to Lua is nested more
+// deeply than the limit, which usually means it contains a cycle.
+type MaxDepthExceeded int
+
+func (d MaxDepthExceeded) Error() string {
+	return fmt.Sprintf("Maximum depth exceeded pushing value: %d", int(d))
+}
+
+// MaxReturnsExceeded is returned when a Lua function or chunk returns more
+// values than Luna.MaxReturns allows.
+type MaxReturnsExceeded int
+
+func (n MaxReturnsExceeded) Error() string {
+	return fmt.Sprintf("Maximum number of return values exceeded: %d", int(n))
+}
+
+// InstructionLimit is returned when a script runs more VM instructions than
+// the limit set with SetInstructionLimit.
+type InstructionLimit int
+
+func (n InstructionLimit) Error() string {
+	return fmt.Sprintf("Instruction limit exceeded: %d", int(n))
+}
+
+// SourceTooLong is returned when source code is longer than
+// Luna.MaxSourceLen allows.
+type SourceTooLong int
+
+func (n SourceTooLong) Error() string {
+	return fmt.Sprintf("Source is longer than the limit of %d bytes", int(n))
+}
+
+// AssertError is returned when a script fails an assert().
+type AssertError struct {
+	Message string
+}
+
+func (e AssertError) Error() string {
+	return e.Message
+}
+
+// TypeError is returned when a Lua value can't be assigned to a Go value.
+type TypeError struct {
+	// Field is the name of the struct field being set, if any
+	Field   string
+	LuaType string
+	GoType  reflect.Type
+}
+
+func (e *TypeError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("Cannot assign Lua %s to Go %s", e.LuaType, e.GoType)
+	}
+	return fmt.Sprintf("Cannot assign Lua %s to Go %s (field %s)", e.LuaType, e.GoType, e.Field)
+}
+
+// UnknownFieldError is returned when a Lua table assigned to a Go struct has
+// a key that doesn't match any of its fields, if ErrorOnUnknownFields is used.
+type UnknownFieldError struct {
+	Field  string
+	GoType reflect.Type
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("Field %s doesn't exist in Go %s", e.Field, e.GoType)
+}
+
+// UnknownFieldPolicy decides what happens to keys of a Lua table that don't
+// match a field of the Go struct it's assigned to. If it returns an error, the
+// assignment fails with it.
+type UnknownFieldPolicy func(*UnknownFieldError) error
+
+var (
+	// IgnoreUnknownFields silently skips unknown keys, which is the default
+	IgnoreUnknownFields UnknownFieldPolicy = func(*UnknownFieldError) error { return nil }
+	// ErrorOnUnknownFields fails with an *UnknownFieldError
+	ErrorOnUnknownFields UnknownFieldPolicy = func(err *UnknownFieldError) error { return err }
+)
+
+// LogUnknownFields skips unknown keys, logging each to logger, or the standard
+// logger if it's nil.
+func LogUnknownFields(logger *log.Logger) UnknownFieldPolicy {
+	return func(err *UnknownFieldError) error {
+		if logger == nil {
+			log.Println(err)
+		} else {
+			logger.Println(err)
+		}
+		return nil
+	}
+}
+
+// MismatchedFieldPolicy is told about each field of a Lua table skipped by
+// SkipMismatchedFields because its value can't be assigned to the Go struct
+// field. If it returns an error, the assignment fails with it after all.
+type MismatchedFieldPolicy func(*TypeError) error
+
+// LogMismatchedFields logs each skipped field to logger, or the standard
+// logger if it's nil.
+func LogMismatchedFields(logger *log.Logger) MismatchedFieldPolicy {
+	return func(err *TypeError) error {
+		if logger == nil {
+			log.Println("Skipping field:", err)
+		} else {
+			logger.Println("Skipping field:", err)
+		}
+		return nil
+	}
+}
+
 type Lib uint
 
 const (
@@ -27,33 +158,271 @@ const (
 	LibString
 	LibTable
 	LibOS
+	LibDebug
 )
 
 const (
 	NoLibs Lib = 0
 
 	// AllLibs represents all available Lua standard libraries
-	AllLibs = LibBase | LibIO | LibMath | LibPackage | LibString | LibTable | LibOS
+	AllLibs = LibBase | LibIO | LibMath | LibPackage | LibString | LibTable | LibOS | LibDebug
 )
 
+// TableKeyValue is a member of a library created with CreateLibrary. If Val
+// is a []TableKeyValue, the member is a nested table with those members, so
+// functions can be grouped like `mylib.sub.func`. A LuaTable, like one made
+// with BuildTable, is also rebuilt as a nested table.
 type TableKeyValue struct {
 	Key string
 	Val interface{}
 }
 
+// LuaMarshaler is implemented by types that convert themselves to a Lua value
+// when pushed, like json.Marshaler.
+type LuaMarshaler interface {
+	MarshalLua() (LuaValue, error)
+}
+
+// LuaArrayer is implemented by types that should be pushed to Lua as an array
+// (a table with keys 1..n) of the returned elements instead of as a table of
+// their fields.
+type LuaArrayer interface {
+	LuaArray() []interface{}
+}
+
 type Luna struct {
 	CallTimeout time.Duration
-	L           *lua.State
 
-	lib     Lib
-	mut     *sync.Mutex
-	running bool
-	err     error
+	// FloatInts pushes Go integers as Lua floats instead of integers. On Lua
+	// 5.1 all numbers are floats anyway, but on Lua builds with an integer
+	// subtype this makes math.type() report "float" like it would on 5.1.
+	FloatInts bool
+
+	// MaxPushDepth limits how deeply nested a struct, map, slice or pointer
+	// pushed to Lua can be. If zero, DefaultMaxPushDepth is used.
+	MaxPushDepth int
+
+	// SkipNils omits nil map values and slice elements when pushing, instead
+	// of setting them to nil. Slices are compacted, so the resulting array has
+	// no holes.
+	SkipNils bool
+
+	// SkipMismatchedFields skips fields of a Lua table that can't be
+	// assigned to the corresponding Go struct field, instead of failing.
+	SkipMismatchedFields bool
+
+	// MismatchedFields is called for the fields skipped by
+	// SkipMismatchedFields. If nil, they're skipped silently.
+	MismatchedFields MismatchedFieldPolicy
+
+	// UseSetters makes keys of a Lua table that don't match an exported
+	// field of the Go struct it's assigned to call a method Set<Key> instead,
+	// if there is one.
+	UseSetters bool
+
+	// Rounding controls how fractional Lua numbers are assigned to Go
+	// integers. The default truncates them.
+	Rounding Rounding
+
+	// TimeEncoding and DurationEncoding control how time.Time and
+	// time.Duration values are pushed to Lua. By default, times are pushed as
+	// seconds since the Unix epoch and durations as nanoseconds.
+	TimeEncoding     TimeEncoding
+	DurationEncoding DurationEncoding
+
+	// UnknownFields is called for keys of a Lua table that don't match a
+	// field of the Go struct it's assigned to. If nil, they're ignored.
+	UnknownFields UnknownFieldPolicy
+
+	// MaxReturns limits how many values a Lua function or chunk can return
+	// to Go. Returning more fails with MaxReturnsExceeded before any of them
+	// are converted. If zero, there's no limit.
+	MaxReturns int
+
+	// TrackGlobals runs chunks passed to Load in an environment that records
+	// assignments to global variables, see LastWrites.
+	TrackGlobals bool
+
+	// MaxSourceLen limits the length in bytes of source code passed to Load,
+	// LoadReader, Preload, Compile, etc. Longer source fails with
+	// SourceTooLong before Lua parses it. If zero, there's no limit.
+	MaxSourceLen int
+
+	// CheckFunctions makes Call and the like return ErrFunctionNotFound when
+	// the global they're asked to call isn't a function, instead of letting
+	// Lua fail with "attempt to call a nil value". Callable tables aren't
+	// functions, so they can't be called while this is set.
+	CheckFunctions bool
+
+	// L is the underlying golua state. Touching it directly is not safe while
+	// a call is running; use WithState instead.
+	L *lua.State
+
+	lib Lib
+	mut sync.Mutex
+
+	// running and err are guarded by stateMut rather than mut, since mut stays
+	// locked while a timed out call is still running
+	stateMut     sync.Mutex
+	running      bool
+	err          error
+	lastDuration time.Duration
+	// pending counts timed out calls that haven't finished yet
+	pending int
+
+	// ctx is checked from the count hook while a chunk runs
+	ctx context.Context
+
+	// interrupt is set by Interrupt and checked from the count hook, and
+	// active counts the chunks running in pcall
+	interrupt atomic.Bool
+	active    atomic.Int32
+
+	// unrefs holds the registry references of LuaFunctions garbage
+	// collected by Go, to be released on the worker at the next lock
+	unrefMut sync.Mutex
+	unrefs   []int
+
+	// work runs functions on the goroutine that owns the Lua state, whose id
+	// is workerID. busy is set while it's running one, since only then can a
+	// caller be on the worker.
+	work     chan func()
+	workerID uint64
+	busy     atomic.Bool
+
+	// number of chunks loaded with Preload, used to name them
+	preloaded int
+
+	// current nesting depth of pushComplexType
+	depth int
+
+	// registry references to the metatables of pushed struct types
+	metatables map[reflect.Type]int
+	// registry reference to the weak table holding the Go values of pushed
+	// structs with methods, see bindReceiver
+	receivers int
+
+	// Go functions registered as globals or library members, by name, for
+	// ValidateRegistrations
+	registered map[string]reflect.Type
+
+	// registry references to the functions of chunks that have been run
+	chunks map[*CompiledChunk]int
+
+	// header of the bytecode this Lua creates, see checkHeader
+	header []byte
+
+	// registry references to the userdata of errors from RegisterErrors
+	errorRefs map[error]int
+
+	// Go pointers pushed as userdata, by the address of their userdata
+	objects map[uintptr]reflect.Value
+
+	// message of the last failed assert(), see checkAssert
+	assertMsg string
+
+	// environment used by TrackGlobals, and the globals written by the last
+	// Load while tracking is set
+	tracker     *Env
+	tracking    bool
+	lastWrites  map[string]LuaValue
+	lastCreated map[string]bool
+
+	// emitters created with PushEmitter, dispatched by Pump
+	emitters []*Emitter
+
+	// registry references to the message handler set with SetMessageHandler
+	// and the function used to install it, or 0 if there is none
+	msgHandler int
+	trampoline int
+
+	// registry reference to debug.traceback, the message handler used when
+	// none is set, or 0 if the debug library isn't open
+	traceback int
+
+	// registry reference to the function Coroutine.Resume uses, or 0 if
+	// none has been created yet
+	resumer int
+
+	// bytes used by the Lua state and the limit on them, kept by alloc once
+	// SetMemoryLimit installs it; memExceeded is set when alloc refuses to
+	// go over the limit
+	tracksMemory bool
+	memUsed      int
+	memLimit     int
+	memExceeded  bool
+
+	// limit set with SetInstructionLimit, the instructions counted towards it
+	// by hook since the current script started, and whether it was reached
+	instrLimit    int
+	instrCount    int
+	instrExceeded bool
+}
+
+// ErrNotInitialized is returned by methods of a Luna that wasn't created with
+// New, or has been closed.
+var ErrNotInitialized = errors.New("Luna is not initialized or has been closed")
+
+// ErrFunctionNotFound is returned, wrapped with the function's name, when
+// calling a global that isn't a function while Luna.CheckFunctions is set.
+var ErrFunctionNotFound = errors.New("Function not found")
+
+// ErrInterrupted is returned when a running script is stopped by Interrupt.
+var ErrInterrupted = errors.New("Script was interrupted")
+
+// ready returns ErrNotInitialized if there's no Lua state to use. It must be
+// called with l locked.
+func (l *Luna) ready() error {
+	if l.L == nil {
+		return ErrNotInitialized
+	}
+	return nil
+}
+
+// Option configures a Luna created with NewWithOptions.
+type Option func(*Luna) error
+
+// WithScript preloads src (see Preload) when the Luna is created.
+func WithScript(src string) Option {
+	return func(l *Luna) error {
+		return l.Preload(src)
+	}
 }
 
 // New creates a new Luna instance, opening all libs provided.
+// Since the Lua state isn't safe to use from multiple OS threads, all access to
+// it happens on a dedicated goroutine locked to its thread, which is stopped by
+// Close.
 func New(libs Lib) *Luna {
-	l := &Luna{L: lua.NewState(), lib: libs, mut: &sync.Mutex{}}
+	l := &Luna{
+		lib:        libs,
+		metatables: make(map[reflect.Type]int),
+		errorRefs:  make(map[error]int),
+		chunks:     make(map[*CompiledChunk]int),
+		registered: make(map[string]reflect.Type),
+		objects:    make(map[uintptr]reflect.Value),
+	}
+	l.lockThread()
+	l.do(func() { l.open(libs) })
+	return l
+}
+
+// NewWithOptions is like New, but also applies opts in order. All options are
+// applied even if some fail; their errors are joined and returned along with
+// the Luna.
+func NewWithOptions(libs Lib, opts ...Option) (*Luna, error) {
+	l := New(libs)
+	var errs []error
+	for _, opt := range opts {
+		if err := opt(l); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return l, errors.Join(errs...)
+}
+
+func (l *Luna) open(libs Lib) {
+	l.L = lua.NewState()
 	if libs == AllLibs {
 		l.L.OpenLibs()
 	} else {
@@ -78,78 +447,622 @@ func New(libs Lib) *Luna {
 		if libs&LibOS != 0 {
 			l.L.OpenOS()
 		}
+		if libs&LibDebug != 0 {
+			l.L.OpenDebug()
+		}
+	}
+	if libs&LibBase != 0 {
+		l.L.Register("assert", l.assert)
+	}
+	l.L.SetHook(l.hook, hookCount)
+	l.openTraceback()
+}
+
+// assert replaces Lua's assert() so that failures can be reported as an
+// AssertError.
+func (l *Luna) assert(L *lua.State) int {
+	if L.GetTop() == 0 {
+		L.RaiseError("bad argument #1 to 'assert' (value expected)")
+		return 0
+	}
+	if L.ToBoolean(1) {
+		return L.GetTop()
 	}
 
-	return l
+	msg := "assertion failed!"
+	if !L.IsNoneOrNil(2) {
+		msg = L.ToString(2)
+	}
+	l.assertMsg = msg
+	L.RaiseError(msg)
+	return 0
+}
+
+// checkAssert returns an AssertError if err was caused by a failed assert(),
+// otherwise err. It must be called after running any Lua code.
+func (l *Luna) checkAssert(err error) error {
+	msg := l.assertMsg
+	l.assertMsg = ""
+	if err != nil && msg != "" && strings.HasSuffix(err.Error(), msg) {
+		return AssertError{msg}
+	}
+	return err
+}
+
+// hook is run by Lua every hookStep() instructions and raises an error in the
+// running chunk if it should be interrupted.
+func (l *Luna) hook(L *lua.State) {
+	if l.instrLimit > 0 {
+		l.instrCount += l.hookStep()
+		if l.instrCount >= l.instrLimit {
+			l.instrExceeded = true
+			L.RaiseError(InstructionLimit(l.instrLimit).Error())
+			return
+		}
+	}
+	if l.interrupt.Load() {
+		L.RaiseError(ErrInterrupted.Error())
+		return
+	}
+	if l.ctx == nil {
+		return
+	}
+	if err := l.ctx.Err(); err != nil {
+		L.RaiseError(err.Error())
+	}
+}
+
+// hookStep returns how many instructions run between calls to hook, which is
+// hookCount unless a smaller instruction limit needs to be checked sooner.
+func (l *Luna) hookStep() int {
+	if l.instrLimit > 0 && l.instrLimit < hookCount {
+		return l.instrLimit
+	}
+	return hookCount
+}
+
+// SetInstructionLimit stops any script that runs more than n Lua VM
+// instructions, so the Load, Call, etc. that started it returns
+// InstructionLimit. The count starts over with every Load, Call, etc., and
+// doesn't include time spent in Go functions. Unlike CallTimeout, the point
+// where a script is stopped doesn't depend on the speed of the machine. Limits
+// over 1000 instructions are checked every 1000, so a script can run up to
+// 999 more. A limit of 0 removes the limit.
+func (l *Luna) SetInstructionLimit(n int) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		l.instrLimit = n
+		l.L.SetHook(l.hook, l.hookStep())
+	})
+	return
+}
+
+// SetUnknownFieldPolicy sets UnknownFields, which decides what happens to
+// keys of Lua tables that don't match a field of the Go struct they're
+// assigned to, once any running call has finished.
+func (l *Luna) SetUnknownFieldPolicy(policy UnknownFieldPolicy) {
+	defer l.lock()()
+	l.UnknownFields = policy
+}
+
+// FreezeGlobals prevents scripts from creating new global variables, which is
+// useful after setting up libraries and loading trusted scripts. Assigning to
+// an undefined global raises an error; existing globals can still be changed
+// and local variables are unaffected. Since this sets a metatable on _G,
+// anything that creates globals afterwards, including CreateLibrary, fails.
+func (l *Luna) FreezeGlobals() {
+	defer l.lock()()
+	if l.ready() != nil {
+		return
+	}
+	l.do(func() {
+		l.L.PushValue(lua.LUA_GLOBALSINDEX)
+		l.L.NewTable()
+		l.L.PushGoFunction(frozenNewIndex)
+		l.L.SetField(-2, "__newindex")
+		l.L.SetMetaTable(-2)
+		l.L.Pop(1)
+	})
+}
+
+// frozenNewIndex is the __newindex metamethod of _G once it's frozen.
+func frozenNewIndex(L *lua.State) int {
+	L.RaiseError(fmt.Sprintf("Cannot create global '%s'", L.ToString(2)))
+	return 0
+}
+
+// lockThread starts the goroutine that all access to the Lua state happens on.
+// It's locked to its OS thread (see runtime.LockOSThread) so the state never
+// migrates between threads.
+func (l *Luna) lockThread() {
+	work := make(chan func())
+	id := make(chan uint64)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		id <- goid()
+		for fn := range work {
+			l.busy.Store(true)
+			fn()
+			l.busy.Store(false)
+		}
+	}()
+	l.workerID = <-id
+	l.work = work
 }
 
-func (l Luna) Running() bool {
+// goid returns the id of the current goroutine.
+func goid() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// the trace starts with "goroutine <id> [running]:"
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i >= 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+// onWorker reports whether it's called on the goroutine that owns the Lua
+// state, which means it's called by a Go function that Lua is running. The
+// goroutine id is only looked up while the worker is busy, so locking an idle
+// Luna stays cheap.
+func (l *Luna) onWorker() bool {
+	return l.work != nil && l.busy.Load() && goid() == l.workerID
+}
+
+// lock locks l and returns the function to unlock it. When called re-entrantly
+// from a Go function that Lua is running, the lock is already held by whoever
+// started Lua, so nothing is done.
+func (l *Luna) lock() (unlock func()) {
+	if l.onWorker() {
+		return func() {}
+	}
+	l.mut.Lock()
+	if l.L != nil && l.queuedUnrefs() {
+		l.do(l.releaseRefs)
+	}
+	return l.mut.Unlock
+}
+
+// queueUnref schedules ref to be released from the registry at the next lock.
+// It's called from finalizers, which don't run on the worker.
+func (l *Luna) queueUnref(ref int) {
+	l.unrefMut.Lock()
+	l.unrefs = append(l.unrefs, ref)
+	l.unrefMut.Unlock()
+}
+
+// queuedUnrefs reports whether queueUnref has references waiting.
+func (l *Luna) queuedUnrefs() bool {
+	l.unrefMut.Lock()
+	defer l.unrefMut.Unlock()
+	return len(l.unrefs) > 0
+}
+
+// releaseRefs releases the references queued by queueUnref.
+func (l *Luna) releaseRefs() {
+	l.unrefMut.Lock()
+	refs := l.unrefs
+	l.unrefs = nil
+	l.unrefMut.Unlock()
+	for _, ref := range refs {
+		l.L.Unref(lua.LUA_REGISTRYINDEX, ref)
+	}
+}
+
+// do runs fn on the locked thread and waits for it to finish. If the Luna has
+// been closed, or do is called from the locked thread, fn runs on the current
+// goroutine.
+func (l *Luna) do(fn func()) {
+	if l.work == nil || l.onWorker() {
+		fn()
+		return
+	}
+	done := make(chan struct{})
+	l.work <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+// spawn is like do, but doesn't wait for fn to finish.
+func (l *Luna) spawn(fn func()) {
+	if l.work == nil {
+		go fn()
+		return
+	}
+	l.work <- fn
+}
+
+func (l *Luna) Running() bool {
+	l.stateMut.Lock()
+	defer l.stateMut.Unlock()
 	return l.running
 }
 
+func (l *Luna) setState(running bool, err error) {
+	l.stateMut.Lock()
+	defer l.stateMut.Unlock()
+	l.running = running
+	l.err = err
+}
+
+// blocked returns the error of a timed out call that's still running, if any.
+func (l *Luna) blocked() error {
+	l.stateMut.Lock()
+	defer l.stateMut.Unlock()
+	if l.running {
+		return l.err
+	}
+	return nil
+}
+
 // Stdout changes where print() writes to (default os.Stdout).
 // Note, this does **not** change anything in the io package.
 func (l *Luna) Stdout(w io.Writer) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	l.L.Register("print", wrapperGen(l, reflect.ValueOf(printGen(w))))
+	defer l.lock()()
+	if l.ready() != nil {
+		return
+	}
+	l.do(func() {
+		l.L.Register("print", printGen(w))
+	})
 }
 
-// loads and executes a Lua source file
+// WithState runs fn with the raw Lua state while holding the lock, so it
+// won't race with Call, Load, etc.
+func (l *Luna) WithState(fn func(*lua.State) error) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() { err = fn(l.L) })
+	return
+}
+
+// loads and executes a Lua source file, like Load. The chunk is named after
+// the file, so errors read like "path/to/script.lua:42: ...".
 func (l *Luna) LoadFile(path string) (LuaRet, error) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	err := l.L.DoFile(path)
+	src, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return l.getReturnValues(), nil
+	// like lua_loadfile, skip a leading "#!" line, keeping the line numbers
+	if len(src) > 0 && src[0] == '#' {
+		if i := bytes.IndexByte(src, '\n'); i >= 0 {
+			src = src[i:]
+		} else {
+			src = nil
+		}
+	}
+	return l.load(context.Background(), "@"+path, string(src))
 }
 
 // loads and executes Lua source
 func (l *Luna) Load(src string) (LuaRet, error) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	err := l.L.DoString(src)
+	return l.LoadContext(context.Background(), src)
+}
+
+// LoadContext is like Load, but aborts the chunk if ctx is done before it
+// finishes. In that case ctx.Err() is returned.
+func (l *Luna) LoadContext(ctx context.Context, src string) (LuaRet, error) {
+	return l.load(ctx, "", src)
+}
+
+// LoadReader is like Load, but reads the source from r. If MaxSourceLen is
+// set, reading stops as soon as the source is known to be too long.
+func (l *Luna) LoadReader(r io.Reader) (LuaRet, error) {
+	if l.MaxSourceLen > 0 {
+		r = io.LimitReader(r, int64(l.MaxSourceLen)+1)
+	}
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return l.Load(string(src))
+}
+
+// LoadNamed is like Load, but names the chunk <name>, typically its file name,
+// so errors read like "myscript.lua:42: ..." instead of quoting the source.
+func (l *Luna) LoadNamed(name, src string) (LuaRet, error) {
+	return l.load(context.Background(), name, src)
+}
+
+func (l *Luna) load(ctx context.Context, name, src string) (LuaRet, error) {
+	defer l.lock()()
+	if err := l.ready(); err != nil {
+		return nil, err
+	}
+
+	prev := l.ctx
+	l.ctx = ctx
+	defer func() { l.ctx = prev }()
+
+	var ret LuaRet
+	var err error
+	l.do(func() {
+		var env *Env
+		if l.TrackGlobals {
+			env = l.trackingEnv()
+			l.lastWrites = make(map[string]LuaValue)
+			l.lastCreated = make(map[string]bool)
+			l.tracking = true
+			defer func() { l.tracking = false }()
+		}
+		base := l.L.GetTop()
+		if err = l.doString(env, name, src); err == nil {
+			ret, err = l.getReturnValues(base)
+		}
+	})
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
-	return l.getReturnValues(), nil
+	return ret, nil
+}
+
+// Preload runs src, discarding any return values. It's meant for scripts that
+// define helper functions at startup. Each preloaded chunk is named
+// "preload <n>", so errors read like "preload 2:3: ...".
+func (l *Luna) Preload(src string) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.preloaded++
+	name := fmt.Sprintf("preload %d", l.preloaded)
+	l.do(func() { err = l.runChunk(name, src) })
+	return
+}
+
+// runChunk compiles and runs src as a chunk named <name>, discarding its
+// return values.
+func (l *Luna) runChunk(name, src string) error {
+	if err := l.checkSourceLen(src); err != nil {
+		return err
+	}
+	top := l.L.GetTop()
+	defer l.L.SetTop(top)
+
+	// a leading '=' tells Lua to use the name as-is in messages
+	if l.L.LoadBuffer([]byte(src), len(src), "="+name) != 0 {
+		return newLunaError(l.L.ToString(-1))
+	}
+	return l.checkAssert(l.pcall(0, 0))
+}
+
+// doString compiles and runs src as a chunk named <name> in env, or the real
+// globals if env is nil, leaving its return values on the stack. Without a
+// name, Lua names the chunk after its source.
+func (l *Luna) doString(env *Env, name, src string) error {
+	if err := l.checkSourceLen(src); err != nil {
+		return err
+	}
+	if name == "" {
+		if l.L.LoadString(src) != 0 {
+			err := newLunaError(l.L.ToString(-1))
+			l.L.Pop(1)
+			return err
+		}
+	} else if err := l.loadBuffer([]byte(src), name); err != nil {
+		return err
+	}
+	if env != nil {
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, env.ref)
+		l.L.SetfEnv(-2)
+	}
+	return l.checkAssert(l.pcall(0, lua.LUA_MULTRET))
+}
+
+// checkSourceLen returns SourceTooLong if src is longer than MaxSourceLen.
+func (l *Luna) checkSourceLen(src string) error {
+	if l.MaxSourceLen > 0 && len(src) > l.MaxSourceLen {
+		return SourceTooLong(l.MaxSourceLen)
+	}
+	return nil
+}
+
+// trampolineSrc calls a function with a message handler. Unlike xpcall in Lua
+// 5.1, it passes arguments through.
+const trampolineSrc = `
+local xpcall, unpack, select, error = xpcall, unpack, select, error
+local function pack(...)
+	return select('#', ...), {...}
+end
+return function(handler, fn, ...)
+	local n, args = pack(...)
+	local rn, res = pack(xpcall(function() return fn(unpack(args, 1, n)) end, handler))
+	if not res[1] then
+		error(res[2], 0)
+	end
+	return unpack(res, 2, rn)
+end`
+
+// SetMessageHandler installs fn, a Go function, as the message handler for
+// code run by Call, Load, etc. It's called with the error object before the
+// stack unwinds, and its return value becomes the error. Passing nil removes
+// the handler. This requires LibBase; without it, an error is returned.
+func (l *Luna) SetMessageHandler(fn interface{}) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+
+		if fn != nil {
+			if err = l.loadTrampoline(); err != nil {
+				return
+			}
+		}
+		if l.msgHandler != 0 {
+			l.L.Unref(lua.LUA_REGISTRYINDEX, l.msgHandler)
+			l.msgHandler = 0
+		}
+		if fn == nil {
+			return
+		}
+
+		if err = l.push(fn); err != nil {
+			return
+		}
+		l.msgHandler = l.L.Ref(lua.LUA_REGISTRYINDEX)
+	})
+	return
+}
+
+// Interrupt stops the script that's running, if any, the next time the count
+// hook runs. The Load, Call, etc. that started it returns ErrInterrupted. It's
+// safe to call from any goroutine. Like timeouts, a script blocked outside of
+// Lua can't be interrupted until it returns to Lua.
+func (l *Luna) Interrupt() {
+	if l.active.Load() > 0 {
+		l.interrupt.Store(true)
+	}
+}
+
+// pcall calls the function below the nargs arguments on top of the stack,
+// using the message handler, if there is one, or else debug.traceback. Errors
+// are returned as a *LunaError, unless they're caused by a limit.
+func (l *Luna) pcall(nargs, nresults int) (err error) {
+	// an Interrupt racing with the end of the last script is forgotten
+	if l.active.Add(1) == 1 {
+		l.interrupt.Store(false)
+		l.memExceeded = false
+		l.instrCount = 0
+		l.instrExceeded = false
+	}
+	defer func() {
+		err = luaError(err)
+		if err != nil && l.instrExceeded {
+			err = InstructionLimit(l.instrLimit)
+		}
+		if err != nil && l.memExceeded {
+			err = MemoryLimitExceeded(l.memLimit)
+		}
+		if err != nil && l.interrupt.Load() {
+			err = ErrInterrupted
+		}
+		if l.active.Add(-1) == 0 {
+			l.interrupt.Store(false)
+		}
+	}()
+
+	handler := l.msgHandler
+	if handler == 0 {
+		handler = l.traceback
+	}
+	if handler != 0 {
+		fn := l.L.GetTop() - nargs
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, l.trampoline)
+		l.L.Insert(fn)
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, handler)
+		l.L.Insert(fn + 1)
+		nargs += 2
+	}
+	return l.L.Call(nargs, nresults)
 }
 
 func (l *Luna) CloseWait() {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	l.L.Close()
+	defer l.lock()()
+	if l.ready() != nil {
+		return
+	}
+	l.do(l.L.Close)
+	l.L = nil
+	l.unrefMut.Lock()
+	l.unrefs = nil
+	l.unrefMut.Unlock()
+	if l.work != nil {
+		close(l.work)
+		l.work = nil
+	}
 }
 
 // If another function is running, closing will not block
 // If you want to be sure it's closed, use CloseWait instead
 func (l *Luna) Close() {
-	if l.running {
+	if l.Running() {
 		go l.CloseWait()
 	} else {
 		l.CloseWait()
 	}
 }
 
-func (l *Luna) getReturnValues() LuaRet {
-	iret := l.L.GetTop()
+// getReturnValues pops everything above base off the stack. If there are
+// more than MaxReturns, they're discarded and MaxReturnsExceeded is returned.
+func (l *Luna) getReturnValues(base int) (LuaRet, error) {
+	iret := l.L.GetTop() - base
+	if l.MaxReturns > 0 && iret > l.MaxReturns {
+		l.L.SetTop(base)
+		return nil, MaxReturnsExceeded(l.MaxReturns)
+	}
 	ret := make(LuaRet, iret)
-	for i := l.L.GetTop(); i > 0; i = l.L.GetTop() {
-		ret[i-1] = l.pop(i)
+	for i := l.L.GetTop(); i > base; i = l.L.GetTop() {
+		val, err := l.pop(i)
+		if err != nil {
+			l.L.SetTop(base)
+			return nil, err
+		}
+		ret[i-base-1] = val
 		l.L.Pop(1)
 	}
-	return ret
+	return ret, nil
 }
 
 func (l *Luna) call(success chan<- LuaRet, fail chan<- error, name string, args ...interface{}) {
-	var err error
+	base := l.L.GetTop()
+	if err := l.invoke(name, args...); err != nil {
+		fail <- err
+		return
+	}
+	ret, err := l.getReturnValues(base)
+	if err != nil {
+		fail <- err
+		return
+	}
+	success <- ret
+}
 
-	top := l.L.GetTop()
+// callSync runs call on the Lua thread and waits for its result.
+func (l *Luna) callSync(name string, args ...interface{}) (LuaRet, error) {
+	success := make(chan LuaRet, 1)
+	fail := make(chan error, 1)
+	l.do(func() { l.call(success, fail, name, args...) })
+	select {
+	case ret := <-success:
+		return ret, nil
+	case err := <-fail:
+		return nil, err
+	}
+}
+
+// invoke calls the global function <name>, leaving its return values on the
+// stack. If there's an error, the stack is restored.
+func (l *Luna) invoke(name string, args ...interface{}) error {
+	l.L.GetGlobal(name)
+	if l.CheckFunctions && !l.L.IsFunction(-1) {
+		l.L.Pop(1)
+		return fmt.Errorf("%w: %s", ErrFunctionNotFound, name)
+	}
+	return l.invokeTop(args...)
+}
+
+// invokeTop is like invoke, but calls the function on top of the stack.
+func (l *Luna) invokeTop(args ...interface{}) (err error) {
+	top := l.L.GetTop() - 1
 	defer func() {
-		if err := recover(); err != nil {
-			fail <- fmt.Errorf("%s", err)
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%s", e)
 		}
 		if err == nil {
 			return
@@ -159,102 +1072,598 @@ func (l *Luna) call(success chan<- LuaRet, fail chan<- error, name string, args
 		l.L.SetTop(top)
 	}()
 
-	l.L.GetGlobal(name)
 	for _, arg := range args {
 		if l.pushBasicType(arg) {
 			continue
 		}
 
-		if err = l.pushComplexType(arg); err != nil {
-			fail <- err
-			return
-		}
+		if err = l.pushComplexType(arg); err != nil {
+			return
+		}
+	}
+	start := time.Now()
+	err = l.pcall(len(args), lua.LUA_MULTRET)
+	l.stateMut.Lock()
+	l.lastDuration = time.Since(start)
+	l.stateMut.Unlock()
+	return l.checkAssert(err)
+}
+
+// LastCallDuration returns how long the Lua function run by the most recent
+// call took, not counting converting arguments and return values.
+func (l *Luna) LastCallDuration() time.Duration {
+	l.stateMut.Lock()
+	defer l.stateMut.Unlock()
+	return l.lastDuration
+}
+
+// PendingCalls returns the number of calls that timed out but are still
+// running in the background. A count that stays above zero usually means a
+// script is stuck.
+func (l *Luna) PendingCalls() int {
+	l.stateMut.Lock()
+	defer l.stateMut.Unlock()
+	return l.pending
+}
+
+// Call calls a Lua function named <string> with the provided arguments.
+// If CallTimeout is non-zero, this function will abort the function call after
+// the specified timeout, returning Timeout. The running chunk is interrupted by
+// a hook, so the state can be used again right away.
+// Note, a call blocked outside of Lua (e.g. in a Go or C function) can't be
+// interrupted; it keeps running in the background and future calls fail
+// immediately until it finishes.
+// Call can be used from Go functions called by Lua, in which case it runs
+// immediately and CallTimeout is not used.
+func (l *Luna) Call(name string, args ...interface{}) (ret LuaRet, err error) {
+	if l.onWorker() {
+		return l.callSync(name, args...)
+	}
+	if err = l.blocked(); err != nil {
+		return
+	}
+
+	l.mut.Lock()
+	l.setState(true, nil)
+	timedOut := false
+	defer func() {
+		if !timedOut {
+			l.setState(false, nil)
+			l.mut.Unlock()
+		}
+	}()
+	if err = l.ready(); err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	var c <-chan struct{}
+	if l.CallTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.CallTimeout)
+		defer cancel()
+		c = ctx.Done()
+	}
+	success := make(chan LuaRet, 1)
+	fail := make(chan error, 1)
+	l.spawn(func() {
+		// the hook raises an error in the chunk once ctx is done
+		prev := l.ctx
+		l.ctx = ctx
+		defer func() { l.ctx = prev }()
+		l.call(success, fail, name, args...)
+	})
+	select {
+	case ret = <-success:
+		return
+	case err = <-fail:
+		if ctx.Err() != nil {
+			err = Timeout(name)
+		}
+		return
+	case <-c:
+		err = Timeout(name)
+		// give the hook a chance to interrupt the chunk
+		select {
+		case <-success:
+			return nil, err
+		case <-fail:
+			return nil, err
+		case <-time.After(timeoutGrace):
+		}
+
+		timedOut = true
+		l.setState(true, err)
+		l.stateMut.Lock()
+		l.pending++
+		l.stateMut.Unlock()
+		go func() {
+			select {
+			case <-success:
+			case <-fail:
+			}
+
+			// recover
+			l.stateMut.Lock()
+			l.pending--
+			l.stateMut.Unlock()
+			l.setState(false, nil)
+			l.mut.Unlock()
+		}()
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Call2 calls a Lua function that returns two values and unmarshals them into
+// an A and a B. An error is returned if the function doesn't return exactly two
+// values or they can't be converted.
+func Call2[A, B any](l *Luna, name string, args ...interface{}) (a A, b B, err error) {
+	ret, err := l.Call(name, args...)
+	if err != nil {
+		return
+	}
+	if len(ret) != 2 {
+		err = fmt.Errorf("Expected 2 return values from %s, got %d", name, len(ret))
+		return
+	}
+	err = ret.Unmarshal(&a, &b)
+	return
+}
+
+// CallContext is like Call, but aborts the function if ctx is done before it
+// returns, in which case ctx.Err() is returned. The deadline of ctx is absolute,
+// so a single ctx can be shared by a sequence of calls that should collectively
+// finish in time. CallTimeout is not used.
+// Note, a function blocked outside of Lua (e.g. in a Go or C function) can't be
+// interrupted until it returns to Lua.
+func (l *Luna) CallContext(ctx context.Context, name string, args ...interface{}) (LuaRet, error) {
+	if !l.onWorker() {
+		if err := l.blocked(); err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer l.lock()()
+	if err := l.ready(); err != nil {
+		return nil, err
+	}
+
+	prev := l.ctx
+	l.ctx = ctx
+	defer func() { l.ctx = prev }()
+
+	ret, err := l.callSync(name, args...)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return ret, err
+}
+
+// CallVoid is like Call, but discards any return values without converting
+// them, which is cheaper for functions called only for their side effects.
+// CallTimeout is not used.
+func (l *Luna) CallVoid(name string, args ...interface{}) (err error) {
+	if !l.onWorker() {
+		if err = l.blocked(); err != nil {
+			return
+		}
+	}
+
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		if err = l.invoke(name, args...); err == nil {
+			l.L.SetTop(top)
+		}
+	})
+	return
+}
+
+// CallWith is like Call, but takes its arguments as a slice, which is only
+// used until CallWith returns and isn't retained. Callers making many calls can
+// reuse the same buffer for each, refilling it in between, and since the call
+// runs without the goroutine and channels Call uses for timeouts, it allocates
+// less. CallTimeout is not used.
+func (l *Luna) CallWith(args []interface{}, name string) (ret LuaRet, err error) {
+	if !l.onWorker() {
+		if err = l.blocked(); err != nil {
+			return
+		}
+	}
+
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		base := l.L.GetTop()
+		if err = l.invoke(name, args...); err == nil {
+			ret, err = l.getReturnValues(base)
+		}
+	})
+	return
+}
+
+// Batch makes calls for Luna.Batch.
+type Batch struct {
+	l *Luna
+}
+
+// Call calls the Lua function <name> like Luna.Call, as part of the batch.
+func (b *Batch) Call(name string, args ...interface{}) (ret LuaRet, err error) {
+	base := b.l.L.GetTop()
+	if err = b.l.invoke(name, args...); err != nil {
+		return
+	}
+	return b.l.getReturnValues(base)
+}
+
+// Batch runs fn, which makes calls with b, holding the lock the whole time.
+// That's cheaper than separate calls to Call, and nothing else can run in
+// between them. Each call returns its own results and error; a failing call
+// doesn't stop the batch. fn runs on the goroutine that owns the Lua state, so
+// it should return quickly. CallTimeout is not used.
+func (l *Luna) Batch(fn func(b *Batch)) error {
+	if !l.onWorker() {
+		if err := l.blocked(); err != nil {
+			return err
+		}
+	}
+
+	defer l.lock()()
+	if err := l.ready(); err != nil {
+		return err
+	}
+	l.do(func() { fn(&Batch{l}) })
+	return nil
+}
+
+// ReturnMode controls how the results of a Go function called from Lua are
+// returned to Lua.
+type ReturnMode int
+
+const (
+	// PushAllResults pushes every result, including errors, which is how Go
+	// functions are normally called
+	PushAllResults ReturnMode = iota
+	// TranslateErrors raises a final error result as a Lua error if it's
+	// non-nil, and otherwise drops it from the results
+	TranslateErrors
+)
+
+// FuncOptions control how a Go function registered with RegisterFuncWith is
+// called from Lua.
+type FuncOptions struct {
+	Returns ReturnMode
+
+	// Spread returns the elements of a final slice or array result as
+	// separate values, so `local a, b = split(s)` works for a Go function
+	// returning []string. It applies after TranslateErrors drops the error.
+	Spread bool
+}
+
+// RegisterFuncWith registers the Go function fn as the global function <name>,
+// called according to opts.
+func (l *Luna) RegisterFuncWith(name string, fn interface{}, opts FuncOptions) (err error) {
+	val := reflect.ValueOf(fn)
+	if val.Kind() != reflect.Func || val.IsNil() {
+		return fmt.Errorf("Not a function: %T", fn)
+	}
+
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		l.L.PushGoFunction(wrapperGen(l, name, val, opts))
+		l.L.SetGlobal(name)
+	})
+	l.register(name, fn)
+	return
+}
+
+// CreateLibrary registers a library <name> with the given members.
+// An error is returned if one of the members is of an unsupported type.
+func (l *Luna) CreateLibrary(name string, members ...TableKeyValue) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() { err = l.createLibrary(nil, name, nil, members) })
+	return
+}
+
+// CreateLibraryWithMeta registers a library <name> like CreateLibrary, with a
+// metatable holding meta. Metamethods like __index, __newindex and __call can
+// be Go functions, which get the library table as their first argument, so
+// undefined members can be resolved by Go:
+//
+//	l.CreateLibraryWithMeta("env", []TableKeyValue{
+//		{"__index", func(_ LuaValue, key string) string { return os.Getenv(key) }},
+//	})
+func (l *Luna) CreateLibraryWithMeta(name string, meta []TableKeyValue, members ...TableKeyValue) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() { err = l.createLibrary(nil, name, meta, members) })
+	return
+}
+
+// RegisterAPI registers a library <name> with the exported function fields of
+// api, a struct or a pointer to one, as its members. The fields are named like
+// struct fields pushed to Lua, so tags like `luna:"name"` can rename or skip
+// them. Fields of other types are ignored.
+func (l *Luna) RegisterAPI(name string, api interface{}) error {
+	val := reflect.Indirect(reflect.ValueOf(api))
+	if val.Kind() != reflect.Struct {
+		return fmt.Errorf("API must be a struct, got %T", api)
+	}
+
+	var members []TableKeyValue
+	for _, f := range reflect.VisibleFields(val.Type()) {
+		key, ok := luaName(f)
+		if !ok || !f.IsExported() || f.Type.Kind() != reflect.Func {
+			continue
+		}
+		members = append(members, TableKeyValue{key, val.FieldByIndex(f.Index).Interface()})
+	}
+	return l.CreateLibrary(name, members...)
+}
+
+// AddModule makes `require "<name>"` call loader, a Go function, instead of
+// searching package.path for the module. require returns the first value the
+// loader returns, typically a table of functions made with BuildTable, and like
+// any module it's only loaded the first time. This requires LibPackage.
+func (l *Luna) AddModule(name string, loader func(*Luna) (LuaRet, error)) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+
+		l.L.GetGlobal("package")
+		if !l.L.IsTable(-1) {
+			err = fmt.Errorf("Package library isn't open")
+			return
+		}
+		l.L.GetField(-1, "preload")
+		if !l.L.IsTable(-1) {
+			err = fmt.Errorf("package.preload isn't a table")
+			return
+		}
+		l.L.PushGoFunction(func(L *lua.State) int {
+			ret, err := loader(l)
+			if err != nil {
+				L.RaiseError(err.Error())
+				return 0
+			}
+			for _, v := range ret {
+				if err := l.pushLuaValue(v); err != nil {
+					L.RaiseError(err.Error())
+					return 0
+				}
+			}
+			return len(ret)
+		})
+		l.L.SetField(-2, name)
+	})
+	return
+}
+
+func (l *Luna) createLibrary(env *Env, name string, meta, members []TableKeyValue) (err error) {
+	top := l.L.GetTop()
+	defer func() {
+		if err != nil {
+			l.L.SetTop(top)
+		}
+	}()
+
+	if err = l.pushMembers(name, members); err != nil {
+		return
+	}
+	if meta != nil {
+		if err = l.pushMembers(name, meta); err != nil {
+			return
+		}
+		l.L.SetMetaTable(-2)
+	}
+
+	l.setGlobal(env, name)
+	l.registerMembers(name, members)
+	l.registerMembers(name, meta)
+	return
+}
+
+// pushMembers pushes a table of members, building nested tables for members
+// that are themselves lists of members. Functions are named after their place
+// in the library, like "prefix.key", in error messages.
+func (l *Luna) pushMembers(prefix string, members []TableKeyValue) error {
+	l.L.NewTable()
+	for _, kv := range members {
+		if sub, ok := kv.Val.([]TableKeyValue); ok {
+			if err := l.pushMembers(prefix+"."+kv.Key, sub); err != nil {
+				return err
+			}
+		} else if fn := reflect.ValueOf(kv.Val); fn.Kind() == reflect.Func && !fn.IsNil() {
+			l.L.PushGoFunction(wrapperGen(l, prefix+"."+kv.Key, fn, FuncOptions{}))
+		} else if !l.pushBasicType(kv.Val) {
+			if err := l.pushComplexType(kv.Val); err != nil {
+				return err
+			}
+		}
+		l.L.SetField(-2, kv.Key)
+	}
+	return nil
+}
+
+// registerMembers registers the functions in members, and in any nested
+// tables, under their full names, like "mylib.sub.func".
+func (l *Luna) registerMembers(prefix string, members []TableKeyValue) {
+	for _, kv := range members {
+		if sub, ok := kv.Val.([]TableKeyValue); ok {
+			l.registerMembers(prefix+"."+kv.Key, sub)
+			continue
+		}
+		l.register(prefix+"."+kv.Key, kv.Val)
+	}
+}
+
+// setGlobal pops the value on top of the stack into the global <name> of env,
+// or the real globals if env is nil.
+func (l *Luna) setGlobal(env *Env, name string) {
+	if env == nil {
+		l.L.SetGlobal(name)
+		return
+	}
+	l.L.RawGeti(lua.LUA_REGISTRYINDEX, env.ref)
+	l.L.Insert(-2)
+	l.L.SetField(-2, name)
+	l.L.Pop(1)
+}
+
+// SetGlobal sets the global <name> to val, converted like a function argument.
+// Structs are pushed as tables, for example.
+func (l *Luna) SetGlobal(name string, val interface{}) error {
+	return l.SetGlobalIn(nil, name, val)
+}
+
+// GetGlobal returns the value of the global <name>. An error is returned if
+// its type can't be returned to Go, like a coroutine.
+func (l *Luna) GetGlobal(name string) (val LuaValue, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		l.L.GetGlobal(name)
+		val, err = l.pop(l.L.GetTop())
+		l.L.Pop(1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := val.(luaTypeError); ok {
+		return nil, fmt.Errorf("Invalid global %s: %s", name, string(e))
+	}
+	return val, nil
+}
+
+// UnmarshalGlobal converts the global <name> into d, which must be a pointer,
+// straight from the Lua stack like the arguments of registered functions.
+// Unlike GetGlobal followed by Unmarshal, integers aren't read through a
+// float64, so large IDs keep their precision on Lua builds with an integer
+// subtype.
+func (l *Luna) UnmarshalGlobal(name string, d interface{}) (err error) {
+	val := reflect.ValueOf(d)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		return fmt.Errorf("Must pass a pointer type to UnmarshalGlobal")
+	}
+
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+		l.L.GetGlobal(name)
+		err = l.set(val.Elem(), -1)
+	})
+	return
+}
+
+// TableBuilder adds entries directly to a Lua table under construction,
+// avoiding an intermediate Go map or slice for large tables.
+type TableBuilder struct {
+	l   *Luna
+	idx int
+	n   int
+}
+
+// Append adds val at the next array index, starting at 1.
+func (b *TableBuilder) Append(val interface{}) error {
+	if err := b.l.push(val); err != nil {
+		return err
 	}
-	err = l.L.Call(len(args), lua.LUA_MULTRET)
-	if err == nil {
-		success <- l.getReturnValues()
-	} else {
-		fail <- err
+	b.n++
+	b.l.L.RawSeti(b.idx, b.n)
+	return nil
+}
+
+// Set sets the field <key> to val.
+func (b *TableBuilder) Set(key string, val interface{}) error {
+	if err := b.l.push(val); err != nil {
+		return err
 	}
+	b.l.L.SetField(b.idx, key)
+	return nil
 }
 
-// Call calls a Lua function named <string> with the provided arguments.
-// If CallTimeout is non-zero, this function will abort the function call after
-// the specified timeout.
-// Note, this does not interrupt the call, so future calls will fail immediately
-// if a blocked call is still executing.
-func (l *Luna) Call(name string, args ...interface{}) (ret LuaRet, err error) {
-	if l.running && l.err != nil {
-		err = l.err
+// BuildTable creates a new Lua table, calls fn to fill it and returns the
+// result. If fn returns an error, the table is discarded and the error returned.
+func (l *Luna) BuildTable(fn func(b *TableBuilder) error) (val LuaValue, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
 		return
 	}
+	l.do(func() { val, err = l.buildTable(fn) })
+	return
+}
 
-	l.mut.Lock()
-	l.running = true
-	defer func() {
-		if l.err == nil {
-			l.running = false
-			l.mut.Unlock()
-		}
-	}()
+func (l *Luna) buildTable(fn func(b *TableBuilder) error) (LuaValue, error) {
+	top := l.L.GetTop()
+	defer l.L.SetTop(top)
 
-	var c <-chan time.Time
-	if l.CallTimeout != 0 {
-		c = time.After(l.CallTimeout)
+	l.L.NewTable()
+	b := &TableBuilder{l: l, idx: l.L.GetTop()}
+	if err := fn(b); err != nil {
+		return nil, err
 	}
-	success := make(chan LuaRet, 1)
-	fail := make(chan error, 1)
-	go l.call(success, fail, name, args...)
-	select {
-	case ret = <-success:
-		return
-	case err = <-fail:
-		return
-	case <-c:
-		l.err = Timeout(name)
-		go func() {
-			select {
-			case <-success:
-			case <-fail:
-			}
+	return l.pop(b.idx)
+}
 
-			// recover
-			l.err = nil
-			l.running = false
-			l.mut.Unlock()
-		}()
-		return nil, l.err
+// LibraryMembers returns the sorted names of the members of the global table
+// <name>, such as one created with CreateLibrary.
+// An error is returned if the global is not a table.
+func (l *Luna) LibraryMembers(name string) (members []string, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
 	}
-	return nil, nil
+	l.do(func() { members, err = l.libraryMembers(name) })
+	return
 }
 
-// CreateLibrary registers a library <name> with the given members.
-// An error is returned if one of the members is of an unsupported type.
-func (l *Luna) CreateLibrary(name string, members ...TableKeyValue) (err error) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-
+func (l *Luna) libraryMembers(name string) ([]string, error) {
 	top := l.L.GetTop()
-	defer func() {
-		if err != nil {
-			l.L.SetTop(top)
-		}
-	}()
+	defer l.L.SetTop(top)
 
-	l.L.NewTable()
-	for _, kv := range members {
-		if l.pushBasicType(kv.Val) {
-			l.L.SetField(-2, kv.Key)
-			continue
-		}
-		if err = l.pushComplexType(kv.Val); err != nil {
-			return
-		}
-		l.L.SetField(-2, kv.Key)
+	l.L.GetGlobal(name)
+	if !l.L.IsTable(-1) {
+		return nil, fmt.Errorf("Not a table: %s", name)
 	}
 
-	l.L.SetGlobal(name)
-	return
+	var members []string
+	l.L.PushNil()
+	for l.L.Next(-2) != 0 {
+		// only string keys can be library members
+		if l.L.Type(-2) == lua.LUA_TSTRING {
+			members = append(members, l.L.ToString(-2))
+		}
+		l.L.Pop(1)
+	}
+	sort.Strings(members)
+	return members, nil
 }
 
 func (l *Luna) pushBasicType(arg interface{}) bool {
@@ -264,25 +1673,25 @@ func (l *Luna) pushBasicType(arg interface{}) bool {
 	case float64:
 		l.L.PushNumber(t)
 	case int:
-		l.L.PushInteger(int64(t))
+		l.pushInteger(int64(t))
 	case int8:
-		l.L.PushInteger(int64(t))
+		l.pushInteger(int64(t))
 	case int16:
-		l.L.PushInteger(int64(t))
+		l.pushInteger(int64(t))
 	case int32:
-		l.L.PushInteger(int64(t))
+		l.pushInteger(int64(t))
 	case int64:
-		l.L.PushInteger(t)
+		l.pushInteger(t)
 	case uint:
-		l.L.PushInteger(int64(t))
+		l.pushInteger(int64(t))
 	case uint8:
-		l.L.PushInteger(int64(t))
+		l.pushInteger(int64(t))
 	case uint16:
-		l.L.PushInteger(int64(t))
+		l.pushInteger(int64(t))
 	case uint32:
-		l.L.PushInteger(int64(t))
+		l.pushInteger(int64(t))
 	case uint64:
-		l.L.PushInteger(int64(t))
+		l.pushInteger(int64(t))
 	case string:
 		l.L.PushString(t)
 	case bool:
@@ -296,47 +1705,205 @@ func (l *Luna) pushBasicType(arg interface{}) bool {
 	return true
 }
 
+// push pushes arg onto the stack, whatever its type.
+func (l *Luna) push(arg interface{}) error {
+	if l.pushBasicType(arg) {
+		return nil
+	}
+	return l.pushComplexType(arg)
+}
+
+// pushInteger pushes i as a Lua integer, or as a float if FloatInts is set.
+func (l *Luna) pushInteger(i int64) {
+	if l.FloatInts {
+		l.L.PushNumber(float64(i))
+		return
+	}
+	l.L.PushInteger(i)
+}
+
 func (l *Luna) pushStruct(arg reflect.Value) error {
 	l.L.NewTable()
 	typ := arg.Type()
 	for i := 0; i < arg.NumField(); i++ {
 		field := arg.Field(i)
-		fieldTyp := typ.Field(i)
-		if !field.CanInterface() {
-			// probably an unexported field, don't try to push
+		name, ok := luaName(typ.Field(i))
+		if !ok || !field.CanInterface() {
+			// skipped or probably an unexported field, don't try to push
+			continue
+		}
+		if field.Kind() == reflect.Interface && isNilInterface(field) {
+			l.L.PushNil()
+			l.L.SetField(-2, name)
 			continue
 		}
 		if l.pushBasicType(field.Interface()) {
-			l.L.SetField(-2, fieldTyp.Name)
+			l.L.SetField(-2, name)
 			continue
 		}
 
 		if err := l.pushComplexType(field.Interface()); err != nil {
 			return err
 		}
-		l.L.SetField(-2, fieldTyp.Name)
+		l.L.SetField(-2, name)
 	}
 
-	/*
-		for i := 0; i < arg.NumMethod(); i++ {
-			//method := arg.Method(i)
-		}
-	*/
+	if typ.NumMethod() > 0 {
+		l.pushMetatable(typ)
+		l.L.SetMetaTable(-2)
+		l.bindReceiver(arg)
+	}
 	return nil
 }
 
-func (l *Luna) pushSlice(arg reflect.Value) error {
+// bindReceiver keeps a copy of arg, the struct pushed as the table on top of
+// the stack, for its methods to be called on. It's kept in the receivers table
+// rather than the struct's table, so scripts and Unmarshal don't see it.
+func (l *Luna) bindReceiver(arg reflect.Value) {
+	recv := reflect.New(arg.Type())
+	recv.Elem().Set(arg)
+	l.pushReceivers()
+	l.L.PushValue(-2)
+	// methods are cached by name next to the receiver at index 1
+	l.L.CreateTable(1, 0)
+	l.pushPointer(recv)
+	l.L.RawSeti(-2, 1)
+	l.L.RawSet(-3)
+	l.L.Pop(1)
+}
+
+// pushReceivers pushes the table mapping the tables of pushed structs to their
+// receivers, whose keys are weak so it doesn't keep the tables alive.
+func (l *Luna) pushReceivers() {
+	if l.receivers != 0 {
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, l.receivers)
+		return
+	}
+	l.L.NewTable()
+	l.L.NewTable()
+	l.L.PushString("k")
+	l.L.SetField(-2, "__mode")
+	l.L.SetMetaTable(-2)
+	l.L.PushValue(-1)
+	l.receivers = l.L.Ref(lua.LUA_REGISTRYINDEX)
+}
+
+// pushMetatable pushes the metatable for structs of type typ, which makes its
+// exported methods available through __index. Methods are called on the Go
+// value that was pushed, kept by bindReceiver, so changes made to the table in
+// Lua aren't seen by them. The metatable is created once per type and kept in
+// the registry.
+func (l *Luna) pushMetatable(typ reflect.Type) {
+	if ref, ok := l.metatables[typ]; ok {
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+		return
+	}
+
 	l.L.NewTable()
-	// for i := arg.Len() - 1; i >= 0; i-- {
+	l.L.PushGoFunction(func(L *lua.State) int {
+		m, ok := typ.MethodByName(L.ToString(2))
+		if !ok {
+			L.PushNil()
+			return 1
+		}
+		l.pushReceivers()
+		L.PushValue(1)
+		L.RawGet(-2)
+		if !L.IsTable(-1) {
+			L.RaiseError("bad self")
+			return 0
+		}
+		L.GetField(-1, m.Name)
+		if !L.IsNil(-1) {
+			return 1
+		}
+		L.Pop(1)
+		L.RawGeti(-1, 1)
+		recv, ok := l.object(-1)
+		if !ok {
+			L.RaiseError("bad self")
+			return 0
+		}
+		L.Pop(1)
+		l.pushMethod(L.ToPointer(1), m.Name, recv.Elem().Method(m.Index))
+		L.PushValue(-1)
+		L.SetField(-3, m.Name)
+		return 1
+	})
+	l.L.SetField(-2, "__index")
+
+	l.L.PushValue(-1)
+	l.metatables[typ] = l.L.Ref(lua.LUA_REGISTRYINDEX)
+}
+
+// pushMethod pushes m, a method named <name> bound to its receiver, as a
+// function that can be called as either obj.Method() or obj:Method(). self is
+// the address of the Lua object it was looked up on, which is dropped from the
+// arguments if it's passed.
+func (l *Luna) pushMethod(self uintptr, name string, m reflect.Value) {
+	fn := wrapperGen(l, name, m, FuncOptions{})
+	l.L.PushGoFunction(func(L *lua.State) int {
+		if L.GetTop() > 0 && L.ToPointer(1) == self {
+			L.Remove(1)
+		}
+		return fn(L)
+	})
+}
+
+// isNilInterface reports whether the interface value v is nil or holds a nil
+// pointer, map, slice, func or channel.
+func isNilInterface(v reflect.Value) bool {
+	if v.IsNil() {
+		return true
+	}
+	switch e := v.Elem(); e.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return e.IsNil()
+	}
+	return false
+}
+
+// isNilValue reports whether v is a nil pointer, map, slice, func, channel or
+// interface.
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface:
+		return isNilInterface(v)
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return v.IsNil()
+	}
+	return false
+}
+
+func (l *Luna) pushSlice(arg reflect.Value) error {
+	// Lua strings hold bytes, so byte slices are pushed as strings
+	if arg.Kind() == reflect.Slice && arg.Type().Elem().Kind() == reflect.Uint8 {
+		l.L.PushString(string(arg.Bytes()))
+		return nil
+	}
+
+	l.L.CreateTable(arg.Len(), 0)
+
+	n := 0
 	for i := 0; i < arg.Len(); i++ {
+		elem := arg.Index(i)
+		if l.SkipNils && isNilValue(elem) {
+			continue
+		}
+		n++
 		// lua has 1-based arrays
-		l.L.PushInteger(int64(i + 1))
-		if l.pushBasicType(arg.Index(i).Interface()) {
+		l.L.PushInteger(int64(n))
+		if elem.Kind() == reflect.Ptr && elem.IsNil() {
+			l.L.PushNil()
+			l.L.SetTable(-3)
+			continue
+		}
+		if l.pushBasicType(elem.Interface()) {
 			l.L.SetTable(-3)
 			continue
 		}
 
-		if err := l.pushComplexType(arg.Index(i).Interface()); err != nil {
+		if err := l.pushComplexType(elem.Interface()); err != nil {
 			return err
 		}
 		l.L.SetTable(-3)
@@ -347,10 +1914,15 @@ func (l *Luna) pushSlice(arg reflect.Value) error {
 func (l *Luna) pushMap(arg reflect.Value) error {
 	l.L.NewTable()
 	for _, k := range arg.MapKeys() {
+		v := arg.MapIndex(k)
+		if l.SkipNils && isNilValue(v) {
+			continue
+		}
 		// push map key
-		l.pushBasicType(k.Interface())
+		if err := l.pushKey(k); err != nil {
+			return err
+		}
 		// push value
-		v := arg.MapIndex(k)
 		if !l.pushBasicType(v.Interface()) {
 			if err := l.pushComplexType(v.Interface()); err != nil {
 				return err
@@ -361,67 +1933,249 @@ func (l *Luna) pushMap(arg reflect.Value) error {
 	return nil
 }
 
+// pushKey pushes the map key k, going by its kind so that named types like
+// `type Key string` work.
+func (l *Luna) pushKey(k reflect.Value) error {
+	switch k.Kind() {
+	case reflect.String:
+		l.L.PushString(k.String())
+	case reflect.Bool:
+		l.L.PushBoolean(k.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		l.pushInteger(k.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		l.pushInteger(int64(k.Uint()))
+	case reflect.Float32, reflect.Float64:
+		l.L.PushNumber(k.Float())
+	default:
+		return fmt.Errorf("Invalid map key type: %s", k.Type())
+	}
+	return nil
+}
+
 func (l *Luna) pushComplexType(arg interface{}) (err error) {
+	if e, ok := arg.(*Emitter); ok {
+		if e.l != l || e.ref == 0 {
+			return fmt.Errorf("Emitter is released or from another Luna")
+		}
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, e.ref)
+		return nil
+	}
+	if s, ok := arg.(*Stream); ok {
+		if s.l != l || s.ref == 0 {
+			return fmt.Errorf("Stream is released or from another Luna")
+		}
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, s.ref)
+		return nil
+	}
+	if f, ok := arg.(*LuaFunction); ok {
+		return l.pushFunction(f)
+	}
+	if co, ok := arg.(*Coroutine); ok {
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, co.ref)
+		return nil
+	}
+	if t, ok := arg.(LuaTable); ok {
+		// rebuilt as a Lua table, rather than pushed as a struct
+		return l.pushLuaValue(t)
+	}
+	if e, ok := arg.(error); ok && l.pushError(e) {
+		return nil
+	}
+	switch t := arg.(type) {
+	case time.Time:
+		l.pushTime(t)
+		return nil
+	case *time.Time:
+		if t == nil {
+			l.L.PushNil()
+		} else {
+			l.pushTime(*t)
+		}
+		return nil
+	case time.Duration:
+		l.pushDuration(t)
+		return nil
+	}
+
+	max := l.MaxPushDepth
+	if max == 0 {
+		max = DefaultMaxPushDepth
+	}
+	l.depth++
+	defer func() { l.depth-- }()
+	if l.depth > max {
+		return MaxDepthExceeded(max)
+	}
+	// room for a table, key and value at each level
+	if !l.L.CheckStack(3) {
+		return fmt.Errorf("Lua stack overflow")
+	}
+
+	if m, ok := arg.(LuaMarshaler); ok {
+		lv, err := m.MarshalLua()
+		if err != nil {
+			return err
+		}
+		return l.pushLuaValue(lv)
+	}
+	if a, ok := arg.(LuaArrayer); ok {
+		return l.pushSlice(reflect.ValueOf(a.LuaArray()))
+	}
+
 	typ := reflect.TypeOf(arg)
 	switch typ.Kind() {
 	case reflect.Struct:
 		return l.pushStruct(reflect.ValueOf(arg))
 	case reflect.Func:
-		l.L.PushGoFunction(wrapperGen(l, reflect.ValueOf(arg)))
+		val := reflect.ValueOf(arg)
+		if val.IsNil() {
+			l.L.PushNil()
+			return nil
+		}
+		l.L.PushGoFunction(wrapperGen(l, "", val, FuncOptions{}))
 	case reflect.Array, reflect.Slice:
 		return l.pushSlice(reflect.ValueOf(arg))
 	case reflect.Map:
 		return l.pushMap(reflect.ValueOf(arg))
 	case reflect.Ptr:
-		// TODO: this should eventually use lua userdata instead of just dereferencing
 		val := reflect.ValueOf(arg)
 		if val.IsNil() {
 			l.L.PushNil()
 			return nil
 		}
+		if typ.Elem().Kind() == reflect.Struct {
+			l.pushPointer(val)
+			return nil
+		}
 		ival := val.Elem().Interface()
 		if l.pushBasicType(ival) {
 			return nil
 		}
 		return l.pushComplexType(ival)
+	case reflect.Bool:
+		// named basic types, which pushBasicType doesn't know about
+		l.L.PushBoolean(reflect.ValueOf(arg).Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		l.pushInteger(reflect.ValueOf(arg).Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		l.pushInteger(int64(reflect.ValueOf(arg).Uint()))
+	case reflect.Float32, reflect.Float64:
+		l.L.PushNumber(reflect.ValueOf(arg).Float())
+	case reflect.String:
+		l.L.PushString(reflect.ValueOf(arg).String())
 	default:
 		err = fmt.Errorf("Invalid type: %s", typ.Kind())
 	}
 	return
 }
 
-func (l *Luna) pop(i int) LuaValue {
+// pushLuaValue pushes a value returned from Lua or created by a LuaMarshaler.
+func (l *Luna) pushLuaValue(lv LuaValue) error {
+	switch v := lv.(type) {
+	case nil, LuaNil:
+		l.L.PushNil()
+	case LuaNumber:
+		l.L.PushNumber(float64(v))
+	case LuaBool:
+		l.L.PushBoolean(bool(v))
+	case LuaString:
+		l.L.PushString(string(v))
+	case LuaPointer:
+		l.pushPointer(reflect.ValueOf(v.Ptr))
+	case LuaError:
+		if !l.pushError(v.Err) {
+			return fmt.Errorf("Error isn't registered: %v", v.Err)
+		}
+	case *LuaFunction:
+		return l.pushFunction(v)
+	case LuaTable:
+		if !l.L.CheckStack(3) {
+			return fmt.Errorf("Lua stack overflow")
+		}
+		l.L.CreateTable(len(v.indexed), len(v.mapped)+len(v.booled))
+		for k, val := range v.indexed {
+			l.L.PushNumber(k)
+			if err := l.pushLuaValue(val); err != nil {
+				return err
+			}
+			l.L.RawSet(-3)
+		}
+		for k, val := range v.mapped {
+			if err := l.pushLuaValue(val); err != nil {
+				return err
+			}
+			l.L.SetField(-2, k)
+		}
+		for k, val := range v.booled {
+			l.L.PushBoolean(k)
+			if err := l.pushLuaValue(val); err != nil {
+				return err
+			}
+			l.L.RawSet(-3)
+		}
+	default:
+		return fmt.Errorf("Invalid Lua value: %T", lv)
+	}
+	return nil
+}
+
+// pop converts the value at index i to a LuaValue, leaving it on the stack. An
+// error is only returned if a table's __len metamethod fails.
+func (l *Luna) pop(i int) (LuaValue, error) {
 	switch t := l.L.Type(i); t {
 	case lua.LUA_TNUMBER:
-		return LuaNumber(l.L.ToNumber(i))
+		return LuaNumber(l.L.ToNumber(i)), nil
 	case lua.LUA_TBOOLEAN:
-		return LuaBool(l.L.ToBoolean(i))
+		return LuaBool(l.L.ToBoolean(i)), nil
 	case lua.LUA_TSTRING:
-		return LuaString(l.L.ToString(i))
+		return LuaString(l.L.ToString(i)), nil
 	case lua.LUA_TNIL:
-		return LuaNil(nil)
+		return LuaNil(nil), nil
 	case lua.LUA_TTABLE:
-		table := LuaTable{make(map[float64]LuaValue), make(map[string]LuaValue), make(map[bool]LuaValue)}
+		table := LuaTable{indexed: make(map[float64]LuaValue), mapped: make(map[string]LuaValue), booled: make(map[bool]LuaValue)}
 
 		l.L.PushNil()
 		for l.L.Next(i) != 0 {
+			val, err := l.pop(i + 2)
+			if err != nil {
+				l.L.SetTop(i)
+				return nil, err
+			}
 			switch l.L.Type(i + 1) {
 			case lua.LUA_TNUMBER:
-				table.indexed[l.L.ToNumber(i+1)] = l.pop(i + 2)
+				k := l.L.ToNumber(i + 1)
+				table.indexed[k] = val
+				table.keys = append(table.keys, LuaNumber(k))
 			case lua.LUA_TBOOLEAN:
-				table.booled[l.L.ToBoolean(i+1)] = l.pop(i + 2)
+				k := l.L.ToBoolean(i + 1)
+				table.booled[k] = val
+				table.keys = append(table.keys, LuaBool(k))
 			case lua.LUA_TSTRING:
-				table.mapped[l.L.ToString(i+1)] = l.pop(i + 2)
+				k := l.L.ToString(i + 1)
+				table.mapped[k] = val
+				table.keys = append(table.keys, LuaString(k))
 			}
 
 			l.L.Pop(1)
 		}
 
-		return table
+		// Lua 5.1 ignores __len for tables, so call it ourselves
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+		if l.L.GetMetaField(i, "__len") {
+			l.L.PushValue(i)
+			if err := l.pcall(1, 1); err != nil {
+				return nil, err
+			}
+			if l.L.IsNumber(-1) {
+				n := int(l.L.ToNumber(-1))
+				table.metaLen = &n
+			}
+		}
+
+		return table, nil
 		/*
-			case lua.LUA_TFUNCTION:
-				// TODO: implement
-				fallthrough
 			case lua.LUA_TUSERDATA:
 				// TODO: implement
 				fallthrough
@@ -432,13 +2186,28 @@ func (l *Luna) pop(i int) LuaValue {
 				// TODO: implement
 				fallthrough
 		*/
+	case lua.LUA_TFUNCTION:
+		l.L.PushValue(i)
+		return l.newFunction(l.L.Ref(lua.LUA_REGISTRYINDEX)), nil
+	case lua.LUA_TUSERDATA:
+		if ptr, ok := l.object(i); ok {
+			return LuaPointer{ptr.Interface()}, nil
+		}
+		if e, ok := l.toError(i); ok {
+			return LuaError{e}, nil
+		}
+		return luaTypeError(fmt.Sprintf("Unexpected type: %d", t)), nil
 	default:
-		return luaTypeError(fmt.Sprintf("Unexpected type: %d", t))
+		return luaTypeError(fmt.Sprintf("Unexpected type: %d", t)), nil
 	}
-	return nil
 }
 
 func (l *Luna) tableToStruct(val reflect.Value, i int) error {
+	// the index has to stay valid as keys and values are pushed
+	if i < 0 {
+		i = l.L.GetTop() + i + 1
+	}
+
 	l.L.PushNil()
 	for l.L.Next(i) != 0 {
 		// TODO: ignore bad values?
@@ -446,39 +2215,174 @@ func (l *Luna) tableToStruct(val reflect.Value, i int) error {
 			return fmt.Errorf("Keys must be strings")
 		}
 		name := l.L.ToString(-2)
-		field := val.FieldByName(name)
+		field := fieldByName(val, name)
 		if field.IsValid() {
 			if err := l.set(field, -1); err != nil {
+				typeErr, ok := err.(*TypeError)
+				if !ok {
+					return err
+				}
+				if typeErr.Field == "" {
+					typeErr.Field = name
+				}
+				if !l.SkipMismatchedFields {
+					return typeErr
+				}
+				if l.MismatchedFields != nil {
+					if err := l.MismatchedFields(typeErr); err != nil {
+						return err
+					}
+				}
+			}
+		} else if m := setter(val, name); l.UseSetters && m.IsValid() {
+			arg := reflect.New(m.Type().In(0)).Elem()
+			if err := l.set(arg, -1); err != nil {
+				return err
+			}
+			if err := callSetter(m, arg); err != nil {
+				return err
+			}
+		} else if l.UnknownFields != nil {
+			if err := l.UnknownFields(&UnknownFieldError{Field: name, GoType: val.Type()}); err != nil {
 				return err
 			}
-		} else {
-			// TODO: get rid of this log
-			log.Println("Field doesn't exist:", name)
 		}
 		l.L.Pop(1)
 	}
-	l.L.Pop(1)
 	return nil
 }
 
+// tableToMap sets the entries of the table at index i in the map val, converting
+// keys and values straight from the stack like set.
+func (l *Luna) tableToMap(val reflect.Value, i int) error {
+	if i < 0 {
+		i = l.L.GetTop() + i + 1
+	}
+
+	typ := val.Type()
+	if val.IsNil() {
+		val.Set(reflect.MakeMap(typ))
+	}
+	l.L.PushNil()
+	for l.L.Next(i) != 0 {
+		k := reflect.New(typ.Key()).Elem()
+		v := reflect.New(typ.Elem()).Elem()
+		if err := l.set(k, -2); err != nil {
+			return err
+		}
+		if err := l.set(v, -1); err != nil {
+			return err
+		}
+		val.SetMapIndex(k, v)
+		l.L.Pop(1)
+	}
+	return nil
+}
+
+// toInteger converts the number at index i to an integer. Integral numbers are
+// read with ToInteger, which keeps every bit on Lua builds with an integer
+// subtype; others are rounded according to Rounding.
+func (l *Luna) toInteger(i int) (int64, bool) {
+	f := l.L.ToNumber(i)
+	if n := int64(l.L.ToInteger(i)); float64(n) == f {
+		return n, true
+	}
+	n, ok := l.Rounding.toInteger(f)
+	return int64(n), ok
+}
+
 func (l *Luna) set(val reflect.Value, i int) error {
 	typ := val.Type()
-	switch t := l.L.Type(i); t {
+	if typ == luaValueType {
+		if i < 0 {
+			i = l.L.GetTop() + i + 1
+		}
+		lv, err := l.pop(i)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(lv))
+		return nil
+	}
+
+	if ptr, ok := l.object(i); ok {
+		// a pointer pushed to Lua by pushPointer
+		if ptr.Type().AssignableTo(typ) {
+			val.Set(ptr)
+			return nil
+		}
+		if ptr.Type().Elem().AssignableTo(typ) {
+			val.Set(ptr.Elem())
+			return nil
+		}
+		return &TypeError{LuaType: ptr.Type().String(), GoType: typ}
+	}
+	if typ == luaFunctionType && l.L.IsFunction(i) {
+		if i < 0 {
+			i = l.L.GetTop() + i + 1
+		}
+		lv, err := l.pop(i)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(lv))
+		return nil
+	}
+	if typ.Kind() == reflect.Ptr {
+		if l.L.IsNil(i) {
+			val.Set(reflect.Zero(typ))
+			return nil
+		}
+		if val.IsNil() {
+			val.Set(reflect.New(typ.Elem()))
+		}
+		return l.set(val.Elem(), i)
+	}
+
+	if typ == timeType || typ == durationType {
+		return l.setTime(val, i)
+	}
+
+	t := l.L.Type(i)
+	typeErr := &TypeError{LuaType: l.L.Typename(int(t)), GoType: typ}
+	switch t {
 	case lua.LUA_TNUMBER:
-		if typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Int64 {
-			val.SetInt(int64(l.L.ToNumber(i)))
-		} else if typ.Kind() >= reflect.Uint && typ.Kind() <= reflect.Uint64 {
-			val.SetUint(uint64(l.L.ToNumber(i)))
+		if typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Uint64 {
+			n, ok := l.toInteger(i)
+			if !ok {
+				return typeErr
+			}
+			if typ.Kind() <= reflect.Int64 {
+				val.SetInt(n)
+			} else {
+				val.SetUint(uint64(n))
+			}
 		} else if typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64 {
 			val.SetFloat(l.L.ToNumber(i))
 		} else {
-			return fmt.Errorf("Wrong type")
+			return typeErr
 		}
 	case lua.LUA_TBOOLEAN:
+		if typ.Kind() != reflect.Bool {
+			return typeErr
+		}
 		val.SetBool(l.L.ToBoolean(i))
 	case lua.LUA_TSTRING:
+		if typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 {
+			val.SetBytes([]byte(l.L.ToString(i)))
+			return nil
+		}
+		if typ.Kind() != reflect.String {
+			return typeErr
+		}
 		val.SetString(l.L.ToString(i))
 	case lua.LUA_TTABLE:
+		if typ.Kind() == reflect.Map {
+			return l.tableToMap(val, i)
+		}
+		if typ.Kind() != reflect.Struct {
+			return typeErr
+		}
 		return l.tableToStruct(val, i)
 	case lua.LUA_TNIL:
 		if val.Kind() >= reflect.Bool && val.Kind() <= reflect.Float64 ||
@@ -490,9 +2394,6 @@ func (l *Luna) set(val reflect.Value, i int) error {
 			return fmt.Errorf("Unexpected nil type, reflect.Kind: %d", val.Kind())
 		}
 		/*
-			case lua.LUA_TFUNCTION:
-				// TODO: implement
-				fallthrough
 			case lua.LUA_TUSERDATA:
 				// TODO: implement
 				fallthrough
@@ -503,6 +2404,12 @@ func (l *Luna) set(val reflect.Value, i int) error {
 				// TODO: implement
 				fallthrough
 		*/
+	case lua.LUA_TUSERDATA:
+		e, ok := l.toError(i)
+		if !ok || !reflect.TypeOf(e).AssignableTo(typ) {
+			return typeErr
+		}
+		val.Set(reflect.ValueOf(e))
 	default:
 		return fmt.Errorf("Unexpected type: %d", t)
 	}
@@ -510,12 +2417,18 @@ func (l *Luna) set(val reflect.Value, i int) error {
 }
 
 // FunctionExists checks if a global function named <string> exists in the global table
-func (l *Luna) FunctionExists(name string) bool {
-	top := l.L.GetTop()
-	l.L.GetGlobal(name)
-	// the golua documentation for IsFunction indicates that it only works for
-	// functions pushed from Go to lua, but it seems to work for all lua functions
-	exists := l.L.IsFunction(l.L.GetTop())
-	l.L.SetTop(top)
-	return exists
+func (l *Luna) FunctionExists(name string) (exists bool) {
+	defer l.lock()()
+	if l.ready() != nil {
+		return false
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		l.L.GetGlobal(name)
+		// the golua documentation for IsFunction indicates that it only works for
+		// functions pushed from Go to lua, but it seems to work for all lua functions
+		exists = l.L.IsFunction(l.L.GetTop())
+		l.L.SetTop(top)
+	})
+	return
 }
@@ -3,11 +3,21 @@ package luna
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"os"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/beatgammit/golua/lua"
 )
 
 func (l *Luna) loaded(libs Lib) bool {
@@ -53,6 +63,12 @@ func (l *Luna) loaded(libs Lib) bool {
 			return false
 		}
 	}
+	if libs&LibDebug != 0 {
+		l.L.GetGlobal("debug")
+		if l.L.IsNil(-1) {
+			return false
+		}
+	}
 	return true
 }
 
@@ -137,6 +153,39 @@ func TestLoadFile(t *testing.T) {
 	}
 }
 
+func TestLoadFileErrors(t *testing.T) {
+	// relative paths, since Lua shortens long chunk names in messages
+	tests := []struct {
+		name, src, msg string
+		line           int
+	}{
+		{"test_syntax.lua", "#!/usr/bin/lua\nx = 1\nif x then\n", "'end' expected", 4},
+		{"test_runtime.lua", "local t = nil\n\nreturn t.field\n", "attempt to index", 3},
+	}
+	l := New(LibBase)
+	defer l.Close()
+	for _, tt := range tests {
+		path := tt.name
+		if err := os.WriteFile(path, []byte(tt.src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+		_, err := l.LoadFile(path)
+		var lerr *LunaError
+		if !errors.As(err, &lerr) {
+			t.Errorf("%s: expected a *LunaError, got %#v", tt.name, err)
+			continue
+		}
+		if lerr.Source != path || lerr.Line != tt.line || !strings.Contains(lerr.Message, tt.msg) {
+			t.Errorf("%s: expected %q at %s:%d, got %s:%d: %s", tt.name, tt.msg, path, tt.line, lerr.Source, lerr.Line, lerr.Message)
+		}
+	}
+
+	if _, err := l.LoadFile("test_missing.lua"); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Expected a missing file to fail with ErrNotExist, got:", err)
+	}
+}
+
 func TestNew(t *testing.T) {
 	libs := []Lib{
 		LibBase,
@@ -146,6 +195,7 @@ func TestNew(t *testing.T) {
 		LibString,
 		LibTable,
 		LibOS,
+		LibDebug,
 	}
 
 	for i, l := 0, len(libs); i < l-1; i++ {
@@ -193,6 +243,34 @@ func TestCreateLibrary(t *testing.T) {
 	}
 }
 
+func TestCreateLibraryNested(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	members := []TableKeyValue{
+		{"version", 2},
+		{"math", []TableKeyValue{
+			{"add", func(a, b int) int { return a + b }},
+			{"consts", []TableKeyValue{
+				{"answer", 42},
+			}},
+		}},
+	}
+	if err := l.CreateLibrary("mylib", members...); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	ret, err := l.Load("return mylib.version, mylib.math.add(1, 2), mylib.math.consts.answer")
+	if err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+	if len(ret) != 3 || ret[0] != LuaNumber(2) || ret[1] != LuaNumber(3) || ret[2] != LuaNumber(42) {
+		t.Error("Unexpected results:", ret)
+	}
+
+	if err := l.CreateLibrary("badlib", TableKeyValue{"sub", []TableKeyValue{{"ch", make(chan int)}}}); err == nil {
+		t.Error("Expected an error for an unsupported nested member")
+	}
+}
+
 func TestLibraryCallWithNilValues(t *testing.T) {
 	fun := func(vali int, valf float32, vals string, valb bool) (int, float32, string, bool) {
 		return vali, valf, vals, valb
@@ -435,10 +513,12 @@ func TestCall(t *testing.T) {
 		"Called with struct\n",
 		"[A] = table:{A=3,B=2,}\n",
 	}
+	// nested struct pointers are userdata backed by the Go value, which
+	// pairs() can't iterate, so their fields are read by name
 	nestedStructPtrData := NestedDataPtr{&Data{3, 2}}
 	nestedStructPtrExpected := []string{
-		"Called with struct\n",
-		"[A] = table:{A=3,B=2,}\n",
+		"Called with struct pointer\n",
+		"[A] = userdata:{A=3,B=2,}\n",
 	}
 	mapData := map[string]interface{}{"A": 3, "B": "hello"}
 	mapExpected := []string{
@@ -471,6 +551,12 @@ function struct(obj)
 	object(obj)
 end
 
+function structPtr(obj)
+	print("Called with struct pointer")
+	print(string.format("[A] = %s:{A=%d,B=%d,}", type(obj.A), obj.A.A, obj.A.B))
+	obj.A.A = 7
+end
+
 function map(obj)
   print("Called with map")
   object(obj)
@@ -520,11 +606,14 @@ end
 	test(t, nestedStructExpected, *c)
 	*c = (*c)[:0]
 
-	if _, err := l.Call("struct", nestedStructPtrData); err != nil {
-		t.Error("Error calling 'struct' with a nested struct pointer:", err)
+	if _, err := l.Call("structPtr", nestedStructPtrData); err != nil {
+		t.Error("Error calling 'structPtr' with a nested struct pointer:", err)
 	}
 	test(t, nestedStructPtrExpected, *c)
 	*c = (*c)[:0]
+	if nestedStructPtrData.A.A != 7 {
+		t.Error("Expected Lua to change the nested struct through its pointer, got:", nestedStructPtrData.A.A)
+	}
 
 	if _, err := l.Call("map", mapData); err != nil {
 		t.Error("Error calling 'map':", err)
@@ -663,7 +752,7 @@ end`
 	}
 
 	_, err = l.Call("callMe")
-	if err == nil || err.Error() != "Wrong type" {
+	if err == nil || !strings.Contains(err.Error(), "bad argument #1 to 'testlib.func' (Cannot assign Lua number to Go string)") {
 		t.Fatal("Error call to invalid Lua to Go function does not lead to an error:", err)
 	}
 }
@@ -929,3 +1018,4318 @@ func TestCallTimeout(t *testing.T) {
 		t.Error("Script should still report that it's running")
 	}
 }
+
+func TestCallTimeoutInterrupts(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	l.CallTimeout = 10 * time.Millisecond
+	if _, err := l.Load("function forever() while true do end end function five() return 5 end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	start := time.Now()
+	if _, err := l.Call("forever"); err != Timeout("forever") {
+		t.Error("Expected the infinite loop to time out, got:", err)
+	} else if time.Since(start) > time.Second {
+		t.Error("Interrupting the call took too long")
+	}
+	if l.Running() || l.PendingCalls() != 0 {
+		t.Error("The timed out call should have been interrupted")
+	}
+
+	ret, err := l.Call("five")
+	if err != nil {
+		t.Fatal("State should be usable after a timed out call:", err)
+	}
+	var i int
+	if err := ret.Unmarshal(&i); err != nil || i != 5 {
+		t.Errorf("Expected 5, got %d (err: %v)", i, err)
+	}
+}
+
+func TestWithState(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	err := l.WithState(func(L *lua.State) error {
+		L.PushString("hello")
+		L.SetGlobal("greeting")
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error pushing value:", err)
+	}
+
+	var val string
+	err = l.WithState(func(L *lua.State) error {
+		L.GetGlobal("greeting")
+		defer L.Pop(1)
+		if !L.IsString(-1) {
+			return fmt.Errorf("Expected string, got %s", L.Typename(int(L.Type(-1))))
+		}
+		val = L.ToString(-1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error reading value:", err)
+	}
+	if val != "hello" {
+		t.Errorf("Expected: 'hello', Actual: '%s'", val)
+	}
+
+	expected := fmt.Errorf("oops")
+	if err := l.WithState(func(*lua.State) error { return expected }); err != expected {
+		t.Errorf("Expected callback error to be returned, got: %v", err)
+	}
+}
+
+func TestLoadContext(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := l.LoadContext(ctx, "while true do end"); err != context.DeadlineExceeded {
+		t.Error("Expected the busy loop to be cancelled, got:", err)
+	} else if time.Since(start) > time.Second {
+		t.Error("Cancelling the script took too long")
+	}
+
+	ret, err := l.Load("return 5")
+	if err != nil {
+		t.Fatal("State should be usable after cancelling a load:", err)
+	}
+	var i int
+	if err := ret.Unmarshal(&i); err != nil || i != 5 {
+		t.Errorf("Expected 5, got %d (err: %v)", i, err)
+	}
+}
+
+func TestCallContextCancel(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function forever() while true do end end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := l.CallContext(ctx, "forever"); !errors.Is(err, context.Canceled) {
+		t.Error("Expected the runaway loop to be cancelled, got:", err)
+	} else if time.Since(start) > time.Second {
+		t.Error("Cancelling the call took too long")
+	}
+	if l.Running() || l.PendingCalls() != 0 {
+		t.Error("The cancelled call should have stopped, not been abandoned")
+	}
+
+	if _, err := l.Load("return 5"); err != nil {
+		t.Error("State should be usable after cancelling a call:", err)
+	}
+}
+
+func TestLibraryMembers(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	libMembers := []TableKeyValue{
+		{"fun", func() {}},
+		{"val", 5},
+		{"name", "luna"},
+	}
+	if err := l.CreateLibrary("testlib", libMembers...); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+
+	members, err := l.LibraryMembers("testlib")
+	if err != nil {
+		t.Fatal("Error listing library members:", err)
+	}
+	expected := []string{"fun", "name", "val"}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("Expected: %v, Actual: %v", expected, members)
+	}
+
+	if _, err := l.Load("notatable = 5"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	if _, err := l.LibraryMembers("notatable"); err == nil {
+		t.Error("Expected an error listing members of a non-table")
+	}
+	if _, err := l.LibraryMembers("noexists"); err == nil {
+		t.Error("Expected an error listing members of a missing global")
+	}
+}
+
+func TestCallStructPtrSlice(t *testing.T) {
+	type Data struct {
+		A int
+		B string
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load(`function describe(arr)
+				return arr[1].A, arr[1].B, arr[2], arr[3].A
+			end`); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("describe", []*Data{{3, "hello"}, nil, {5, "world"}})
+	if err != nil {
+		t.Fatal("Error calling 'describe':", err)
+	}
+
+	var (
+		a1, a3  int
+		b1      string
+		missing map[string]int
+	)
+	if err := ret.Unmarshal(&a1, &b1, &missing, &a3); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if a1 != 3 || b1 != "hello" || a3 != 5 {
+		t.Errorf("Unexpected values: %d, '%s', %d", a1, b1, a3)
+	}
+	if missing != nil {
+		t.Error("nil pointer should be pushed as nil")
+	}
+
+	// elements are pushed like a single pointer would be
+	if _, err := l.Load("function first(arr) return arr[1], arr[2] end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	ret, err = l.Call("first", []*money{{150}, nil})
+	if err != nil {
+		t.Fatal("Error calling 'first':", err)
+	}
+	if len(ret) != 2 || ret[0] != LuaString("$1.50") {
+		t.Error("Expected a LuaMarshaler element to be marshalled, got:", ret)
+	} else if _, ok := ret[1].(LuaNil); !ok {
+		t.Error("nil pointer should be pushed as nil, got:", ret[1])
+	}
+}
+
+func BenchmarkPushStructPtrSlice(b *testing.B) {
+	type Data struct {
+		A int
+		B string
+	}
+	data := make([]*Data, 10000)
+	for i := range data {
+		data[i] = &Data{i, "data"}
+	}
+
+	l := New(NoLibs)
+	defer l.Close()
+
+	b.ResetTimer()
+	err := l.WithState(func(L *lua.State) error {
+		for i := 0; i < b.N; i++ {
+			if err := l.pushComplexType(data); err != nil {
+				return err
+			}
+			L.Pop(1)
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestCallIntegerType(t *testing.T) {
+	l := New(LibBase | LibMath)
+	defer l.Close()
+	code := `
+function kind(n)
+	-- floats can't tell 2^53 + 1 from 2^53, integers can
+	local lossy = n + 1 == n
+	-- math.type only exists on Lua builds with an integer subtype
+	if math.type then
+		return type(n), lossy, math.type(n)
+	end
+	return type(n), lossy, nil
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	tests := []struct {
+		floatInts bool
+		mathType  string
+	}{
+		{false, "integer"},
+		{true, "float"},
+	}
+	for _, tt := range tests {
+		l.FloatInts = tt.floatInts
+		ret, err := l.Call("kind", int64(1)<<53)
+		if err != nil {
+			t.Fatal("Error calling 'kind':", err)
+		}
+
+		var typ string
+		if err := ret[0].Unmarshal(&typ); err != nil || typ != "number" {
+			t.Errorf("Expected type 'number', got '%s' (err: %v)", typ, err)
+		}
+		_, hasMathType := ret[2].(LuaString)
+		// without an integer subtype, like on Lua 5.1, every number is a float
+		wantLossy := tt.floatInts || !hasMathType
+		if ret[1] != LuaBool(wantLossy) {
+			t.Errorf("FloatInts=%t: expected 2^53 + 1 == 2^53 to be %t, got %v", tt.floatInts, wantLossy, ret[1])
+		}
+		if !hasMathType {
+			continue
+		}
+		var mathType string
+		if err := ret[2].Unmarshal(&mathType); err != nil || mathType != tt.mathType {
+			t.Errorf("FloatInts=%t: expected math.type '%s', got '%s' (err: %v)", tt.floatInts, tt.mathType, mathType, err)
+		}
+	}
+}
+
+func TestCallContextSharedDeadline(t *testing.T) {
+	l := New(LibBase | LibOS)
+	defer l.Close()
+	code := `
+function spin(ms)
+	local start = os.clock()
+	while os.clock() - start < ms / 1000 do end
+	return ms
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	var errs []error
+	for i := 0; i < 3; i++ {
+		_, err := l.CallContext(ctx, "spin", 40)
+		errs = append(errs, err)
+	}
+	elapsed := time.Since(start)
+
+	if errs[0] != nil || errs[1] != nil {
+		t.Error("First two calls should fit within the deadline:", errs[0], errs[1])
+	}
+	if errs[2] != context.DeadlineExceeded {
+		t.Error("Third call should exceed the shared deadline, got:", errs[2])
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Error("Calls ran far past the shared deadline:", elapsed)
+	}
+
+	if _, err := l.Call("spin", 0); err != nil {
+		t.Error("State should be usable after a cancelled call:", err)
+	}
+}
+
+func TestUnmarshalCoerce(t *testing.T) {
+	var i int
+	if err := LuaString("5").Unmarshal(&i); err == nil {
+		t.Error("Expected strict mode to reject a string for an int")
+	}
+
+	coerce := UnmarshalOptions{Coerce: true}
+	if err := coerce.Unmarshal(LuaString("5"), &i); err != nil {
+		t.Error("Error coercing string to int:", err)
+	} else if i != 5 {
+		t.Errorf("Expected: 5, Actual: %d", i)
+	}
+
+	var f float64
+	if err := coerce.Unmarshal(LuaString(" 0x10 "), &f); err != nil {
+		t.Error("Error coercing hex string to float:", err)
+	} else if f != 16 {
+		t.Errorf("Expected: 16, Actual: %f", f)
+	}
+
+	var s string
+	if err := coerce.Unmarshal(LuaNumber(5), &s); err != nil {
+		t.Error("Error coercing number to string:", err)
+	} else if s != "5" {
+		t.Errorf("Expected: '5', Actual: '%s'", s)
+	}
+
+	if err := coerce.Unmarshal(LuaString("five"), &i); err == nil {
+		t.Error("Expected an error coercing a non-numeric string to an int")
+	}
+	// Go's syntax for numbers accepts more than Lua's
+	for _, str := range []string{"inf", "nan", "0b1", "0o7", "1_0", "0x"} {
+		if err := coerce.Unmarshal(LuaString(str), &f); err == nil {
+			t.Errorf("Expected an error coercing %q to a float, got %v", str, f)
+		}
+	}
+	for str, expected := range map[string]float64{"-0x10": -16, "1e3": 1000, ".5": 0.5, "2.": 2} {
+		if err := coerce.Unmarshal(LuaString(str), &f); err != nil || f != expected {
+			t.Errorf("Expected %q to coerce to %v, got %v (err: %v)", str, expected, f, err)
+		}
+	}
+	if err := coerce.Unmarshal(LuaNumber(math.Inf(1)), &s); err != nil || s != "inf" {
+		t.Errorf("Expected infinity to coerce like tostring, got %q (err: %v)", s, err)
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(`return {a = "1", b = 2}, "3"`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	var m struct {
+		A int
+		B string
+	}
+	var n int
+	if err := ret.UnmarshalWith(coerce, &m, &n); err != nil {
+		t.Fatal("Error unmarshalling with coercion:", err)
+	}
+	if m.A != 1 || m.B != "2" || n != 3 {
+		t.Errorf("Unexpected values: %+v, %d", m, n)
+	}
+}
+
+type vec3 struct {
+	X, Y, Z float64
+}
+
+func (v vec3) LuaArray() []interface{} {
+	return []interface{}{v.X, v.Y, v.Z}
+}
+
+func TestCallLuaArrayer(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load(`function sum(v)
+				return #v, v[1] + v[2] + v[3], v.X
+			end`); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("sum", vec3{1, 2, 3})
+	if err != nil {
+		t.Fatal("Error calling 'sum':", err)
+	}
+
+	var (
+		n   int
+		sum float64
+		x   map[string]int
+	)
+	if err := ret.Unmarshal(&n, &sum, &x); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected array of length 3, got %d", n)
+	}
+	if sum != 6 {
+		t.Errorf("Expected sum of 6, got %f", sum)
+	}
+	if x != nil {
+		t.Error("Fields shouldn't be pushed for a LuaArrayer")
+	}
+}
+
+func TestLuaTableToGoStructPtr(t *testing.T) {
+	type Data struct {
+		A int
+		B string
+	}
+
+	var called int
+	var data *Data
+	test := func(d *Data) {
+		called++
+		data = d
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	if err := l.CreateLibrary("testlib", TableKeyValue{"func", test}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+
+	if _, err := l.Load("testlib.func({A=3,B='hello'})"); err != nil {
+		t.Fatal("Error calling function with a table:", err)
+	}
+	if called != 1 {
+		t.Error("Function not called exactly one time")
+	}
+	if data == nil {
+		t.Fatal("Pointer parameter wasn't allocated")
+	}
+	if expected := (Data{3, "hello"}); *data != expected {
+		t.Errorf("Expected: '%+v', Actual: '%+v'", expected, *data)
+	}
+
+	if _, err := l.Load("testlib.func(nil)"); err != nil {
+		t.Fatal("Error calling function with nil:", err)
+	}
+	if data != nil {
+		t.Error("Lua nil should be passed as a nil pointer")
+	}
+}
+
+func TestBoolToNonBool(t *testing.T) {
+	var i int
+	err := LuaBool(true).Unmarshal(&i)
+	if err == nil || err.Error() != "Cannot assign Lua boolean to Go int" {
+		t.Error("Expected a clear error unmarshalling a boolean into an int, got:", err)
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	if err := l.CreateLibrary("testlib", TableKeyValue{"func", func(int) {}}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	if _, err := l.Load("function callMe() testlib.func(true) end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	_, err = l.Call("callMe")
+	if err == nil || !strings.Contains(err.Error(), "bad argument #1 to 'testlib.func' (Cannot assign Lua boolean to Go int)") {
+		t.Error("Expected a clear error passing a boolean to an int parameter, got:", err)
+	}
+}
+
+func TestBuildTable(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	val, err := l.BuildTable(func(b *TableBuilder) error {
+		for i := 1; i <= 1000; i++ {
+			if err := b.Append(i * 2); err != nil {
+				return err
+			}
+		}
+		return b.Set("name", "doubles")
+	})
+	if err != nil {
+		t.Fatal("Error building table:", err)
+	}
+
+	table, ok := val.(LuaTable)
+	if !ok {
+		t.Fatalf("Expected a LuaTable, got %T", val)
+	}
+	items := table.Slice()
+	if len(items) != 1000 {
+		t.Fatalf("Expected 1000 items, got %d", len(items))
+	}
+	for i, v := range items {
+		if n, ok := v.(LuaNumber); !ok || int(n) != (i+1)*2 {
+			t.Errorf("[%d]: expected %d, got %v", i+1, (i+1)*2, v)
+		}
+	}
+	if name := table.Get("name"); name != LuaString("doubles") {
+		t.Errorf("Expected name 'doubles', got %v", name)
+	}
+
+	_, err = l.BuildTable(func(b *TableBuilder) error {
+		return b.Append(make(chan bool))
+	})
+	if err == nil {
+		t.Error("Expected an error appending an unsupported type")
+	}
+}
+
+func TestReturnTableLen(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	ret, err := l.Load(`return setmetatable({1, 2, 3}, {__len = function() return 10 end}), {1, 2}, {1, 2, [4] = 4, a = 1, b = 2, [true] = 1}`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	proxy := ret[0].(LuaTable)
+	if n := proxy.Len(); n != 10 {
+		t.Errorf("Expected __len result of 10, got %d", n)
+	}
+	if n := proxy.RawLen(); n != 3 {
+		t.Errorf("Expected raw length of 3, got %d", n)
+	}
+
+	plain := ret[1].(LuaTable)
+	if plain.Len() != 2 || plain.RawLen() != 2 {
+		t.Errorf("Expected length of 2, got %d (raw: %d)", plain.Len(), plain.RawLen())
+	}
+
+	mixed := ret[2].(LuaTable)
+	if mixed.Len() != 2 || mixed.Count() != 6 {
+		t.Errorf("Expected length of 2 and 6 entries, got %d and %d", mixed.Len(), mixed.Count())
+	}
+
+	_, err = l.Load(`return setmetatable({}, {__len = function() error("no length") end})`)
+	if err == nil || !strings.Contains(err.Error(), "no length") {
+		t.Error("Expected the __len error to be returned, got:", err)
+	}
+}
+
+type clickCounter struct {
+	clicks int
+}
+
+func (c *clickCounter) Click(n int) {
+	c.clicks += n
+}
+
+func TestCallFuncFields(t *testing.T) {
+	type Callbacks struct {
+		OnClick func()
+		OnHover func()
+	}
+
+	var clicked int
+	cbs := Callbacks{OnClick: func() { clicked++ }}
+	counter := &clickCounter{}
+
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function fire(cbs)
+	cbs.OnClick()
+	return cbs.OnHover == nil
+end
+function fireMap(m)
+	m.click(2)
+	m.click(3)
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("fire", cbs)
+	if err != nil {
+		t.Fatal("Error calling 'fire':", err)
+	}
+	if clicked != 1 {
+		t.Error("Struct func field not called exactly one time:", clicked)
+	}
+	var hoverNil bool
+	if err := ret.Unmarshal(&hoverNil); err != nil || !hoverNil {
+		t.Error("nil func field should be pushed as nil")
+	}
+
+	if _, err := l.Call("fireMap", map[string]interface{}{"click": counter.Click}); err != nil {
+		t.Fatal("Error calling 'fireMap':", err)
+	}
+	if counter.clicks != 5 {
+		t.Errorf("Expected method value to be called with 2 and 3, got %d clicks", counter.clicks)
+	}
+}
+
+func TestUnmarshalSlice(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function three() return 1, 2, 3 end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("three")
+	if err != nil {
+		t.Fatal("Error calling 'three':", err)
+	}
+
+	var vals []int
+	if err := ret.UnmarshalSlice(&vals); err != nil {
+		t.Fatal("Error unmarshalling into slice:", err)
+	}
+	if expected := []int{1, 2, 3}; !reflect.DeepEqual(vals, expected) {
+		t.Errorf("Expected: %v, Actual: %v", expected, vals)
+	}
+
+	var notSlice int
+	if err := ret.UnmarshalSlice(&notSlice); err == nil {
+		t.Error("Expected an error unmarshalling into a non-slice")
+	}
+	var strs []string
+	if err := ret.UnmarshalSlice(&strs); err == nil {
+		t.Error("Expected an error unmarshalling numbers into strings")
+	}
+}
+
+// run with -race
+func TestConcurrentCalls(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function add(a, b) return a + b end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ret, err := l.Call("add", i, j)
+				if err != nil {
+					t.Error("Error calling 'add':", err)
+					return
+				}
+				var sum int
+				if err := ret.Unmarshal(&sum); err != nil || sum != i+j {
+					t.Errorf("Expected %d, got %d (err: %v)", i+j, sum, err)
+				}
+				if _, err := l.Load("local x = 1"); err != nil {
+					t.Error("Error loading code:", err)
+				}
+				l.Running()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestReturnTableEmbeddedStruct(t *testing.T) {
+	type Base struct {
+		Name  string
+		Debug bool
+	}
+	type Config struct {
+		Base
+		Port int
+	}
+	type PtrConfig struct {
+		*Base
+		Port int
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(`return {base = {name = "nested", debug = true}, port = 80},
+		{name = "promoted", debug = true, port = 81},
+		{name = "pointer", port = 82}`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var nested, promoted Config
+	var ptr PtrConfig
+	if err := ret.Unmarshal(&nested, &promoted, &ptr); err != nil {
+		t.Fatal("Error unmarshalling:", err)
+	}
+
+	if expected := (Config{Base{"nested", true}, 80}); nested != expected {
+		t.Errorf("Expected: %+v, Actual: %+v", expected, nested)
+	}
+	if expected := (Config{Base{"promoted", true}, 81}); promoted != expected {
+		t.Errorf("Expected: %+v, Actual: %+v", expected, promoted)
+	}
+	if ptr.Base == nil || ptr.Name != "pointer" || ptr.Port != 82 {
+		t.Errorf("Embedded pointer not filled in: %+v", ptr)
+	}
+}
+
+func TestCallVoid(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("count = 0 function incr() count = count + 1 return count, 'ignored' end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := l.CallVoid("incr"); err != nil {
+			t.Fatal("Error calling 'incr':", err)
+		}
+	}
+
+	ret, err := l.Call("incr")
+	if err != nil {
+		t.Fatal("Error calling 'incr':", err)
+	}
+	// return values from CallVoid shouldn't be left on the stack
+	if len(ret) != 2 {
+		t.Fatalf("Expected 2 return values, got %d", len(ret))
+	}
+	var count int
+	if err := ret[0].Unmarshal(&count); err != nil || count != 4 {
+		t.Errorf("Expected count of 4, got %d (err: %v)", count, err)
+	}
+
+	if err := l.CallVoid("noexists"); err == nil {
+		t.Error("Expected an error calling a missing function")
+	}
+}
+
+func benchmarkNoReturn(b *testing.B, call func(l *Luna) error) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function noop() end"); err != nil {
+		b.Fatal("Error loading test code:", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := call(l); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCallNoReturn(b *testing.B) {
+	benchmarkNoReturn(b, func(l *Luna) error {
+		_, err := l.Call("noop")
+		return err
+	})
+}
+
+func BenchmarkCallVoidNoReturn(b *testing.B) {
+	benchmarkNoReturn(b, func(l *Luna) error {
+		return l.CallVoid("noop")
+	})
+}
+
+func TestCallWith(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function add(a, b) return a + b end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	buf := make([]interface{}, 2)
+	for i := 0; i < 3; i++ {
+		buf[0], buf[1] = i, 10
+		ret, err := l.CallWith(buf, "add")
+		if err != nil {
+			t.Fatal("Error calling 'add':", err)
+		}
+		var n int
+		if err := ret.Unmarshal(&n); err != nil || n != i+10 {
+			t.Errorf("Expected %d, got %d (err: %v)", i+10, n, err)
+		}
+	}
+
+	if _, err := l.CallWith(nil, "noexists"); err == nil {
+		t.Error("Expected an error calling a missing function")
+	}
+}
+
+func benchmarkArgs(b *testing.B, call func(l *Luna, args []interface{}) error) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function add(a, b) return a + b end"); err != nil {
+		b.Fatal("Error loading test code:", err)
+	}
+
+	args := make([]interface{}, 2)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		args[0], args[1] = 1, 2
+		if err := call(l, args); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCallArgs(b *testing.B) {
+	benchmarkArgs(b, func(l *Luna, args []interface{}) error {
+		_, err := l.Call("add", args[0], args[1])
+		return err
+	})
+}
+
+func BenchmarkCallWithArgs(b *testing.B) {
+	benchmarkArgs(b, func(l *Luna, args []interface{}) error {
+		_, err := l.CallWith(args, "add")
+		return err
+	})
+}
+
+func TestPreload(t *testing.T) {
+	l, err := NewWithOptions(LibBase,
+		WithScript("function double(n) return n * 2 end"),
+		WithScript("function greet(name) return 'hello ' .. name end"),
+	)
+	if err != nil {
+		t.Fatal("Error preloading scripts:", err)
+	}
+	defer l.Close()
+
+	if err := l.Preload("function triple(n) return n * 3 end"); err != nil {
+		t.Fatal("Error preloading script:", err)
+	}
+
+	var n int
+	var s string
+	if ret, err := l.Call("double", 2); err != nil {
+		t.Error("Error calling 'double':", err)
+	} else if err := ret.Unmarshal(&n); err != nil || n != 4 {
+		t.Errorf("Expected 4, got %d (err: %v)", n, err)
+	}
+	if ret, err := l.Call("greet", "luna"); err != nil {
+		t.Error("Error calling 'greet':", err)
+	} else if err := ret.Unmarshal(&s); err != nil || s != "hello luna" {
+		t.Errorf("Expected 'hello luna', got '%s' (err: %v)", s, err)
+	}
+	if ret, err := l.Call("triple", 2); err != nil {
+		t.Error("Error calling 'triple':", err)
+	} else if err := ret.Unmarshal(&n); err != nil || n != 6 {
+		t.Errorf("Expected 6, got %d (err: %v)", n, err)
+	}
+
+	l2, err := NewWithOptions(LibBase,
+		WithScript("function ok() end"),
+		WithScript("function broken("),
+		WithScript("error('boom')"),
+	)
+	defer l2.Close()
+	if err == nil {
+		t.Fatal("Expected errors preloading broken scripts")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "preload 2:") || !strings.Contains(msg, "preload 3:") {
+		t.Error("Errors should name the failing chunks:", msg)
+	}
+	if !l2.FunctionExists("ok") {
+		t.Error("Valid scripts should still be loaded")
+	}
+}
+
+func TestLuaNumberIsInteger(t *testing.T) {
+	l := New(LibBase | LibMath)
+	defer l.Close()
+	ret, err := l.Load("return 3, 3.5, -2, math.huge, 0/0")
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	expected := []bool{true, false, true, false, false}
+	for i, exp := range expected {
+		n, ok := ret[i].(LuaNumber)
+		if !ok {
+			t.Errorf("[%d]: expected a LuaNumber, got %T", i, ret[i])
+		} else if n.IsInteger() != exp {
+			t.Errorf("[%d]: %v.IsInteger() should be %t", i, n, exp)
+		}
+	}
+}
+
+func TestCallNilInterfaceFields(t *testing.T) {
+	type Data struct {
+		A int
+	}
+	type Holder struct {
+		Name  string
+		Extra interface{}
+		Ptr   interface{}
+		Map   interface{}
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load(`function check(h)
+				return h.Name, h.Extra == nil, h.Ptr == nil, h.Map == nil
+			end`); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	h := Holder{Name: "holder", Ptr: (*Data)(nil), Map: map[string]int(nil)}
+	ret, err := l.Call("check", h)
+	if err != nil {
+		t.Fatal("Error calling 'check':", err)
+	}
+
+	var name string
+	var extraNil, ptrNil, mapNil bool
+	if err := ret.Unmarshal(&name, &extraNil, &ptrNil, &mapNil); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if name != "holder" {
+		t.Errorf("Expected 'holder', got '%s'", name)
+	}
+	if !extraNil || !ptrNil || !mapNil {
+		t.Errorf("nil interface fields should be pushed as nil: %t, %t, %t", extraNil, ptrNil, mapNil)
+	}
+}
+
+func TestCallMaxPushDepth(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function noop() end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	cyclic := map[string]interface{}{"Val": 1}
+	cyclic["Next"] = cyclic
+	_, err := l.Call("noop", cyclic)
+	if depth, ok := err.(MaxDepthExceeded); !ok {
+		t.Error("Expected MaxDepthExceeded pushing a cyclic value, got:", err)
+	} else if int(depth) != DefaultMaxPushDepth {
+		t.Errorf("Expected default limit of %d, got %d", DefaultMaxPushDepth, depth)
+	}
+
+	deep := map[string]interface{}{"Val": 1}
+	for i := 2; i <= 5; i++ {
+		deep = map[string]interface{}{"Val": i, "Next": deep}
+	}
+	l.MaxPushDepth = 3
+	if _, err := l.Call("noop", deep); err != MaxDepthExceeded(3) {
+		t.Error("Expected MaxDepthExceeded with a small limit, got:", err)
+	}
+	l.MaxPushDepth = 20
+	if _, err := l.Call("noop", deep); err != nil {
+		t.Error("Value within the limit should be pushed:", err)
+	}
+}
+
+func TestCallSkipNils(t *testing.T) {
+	type Data struct {
+		A int
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function describeMap(m)
+	local keys = 0
+	for k, v in pairs(m) do keys = keys + 1 end
+	return keys, m.a, m.b == nil
+end
+function describeSlice(arr)
+	local keys = 0
+	for k, v in pairs(arr) do keys = keys + 1 end
+	return keys, arr[1], arr[2], arr[3]
+end
+function describeStructs(arr)
+	return arr[1].A, arr[2] and arr[2].A
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	m := map[string]interface{}{"a": 1, "b": nil}
+	slice := []interface{}{1, nil, 3}
+	structs := []*Data{{1}, nil, {3}}
+
+	tests := []struct {
+		skipNils bool
+		slice    []interface{}
+		structs  []interface{}
+	}{
+		// holes are left where the nils were
+		{false, []interface{}{2, 1, nil, 3}, []interface{}{1, nil}},
+		// nils are dropped and the array compacted
+		{true, []interface{}{2, 1, 3, nil}, []interface{}{1, 3}},
+	}
+	for _, tt := range tests {
+		l.SkipNils = tt.skipNils
+
+		ret, err := l.Call("describeMap", m)
+		if err != nil {
+			t.Fatal("Error calling 'describeMap':", err)
+		}
+		var keys, a int
+		var bNil bool
+		if err := ret.Unmarshal(&keys, &a, &bNil); err != nil {
+			t.Fatal("Error unmarshalling map results:", err)
+		}
+		if keys != 1 || a != 1 || !bNil {
+			t.Errorf("SkipNils=%t: map should only have key 'a': %d, %d, %t", tt.skipNils, keys, a, bNil)
+		}
+
+		ret, err = l.Call("describeSlice", slice)
+		if err != nil {
+			t.Fatal("Error calling 'describeSlice':", err)
+		}
+		checkNumbers(t, ret, tt.slice)
+
+		ret, err = l.Call("describeStructs", structs)
+		if err != nil {
+			t.Fatal("Error calling 'describeStructs':", err)
+		}
+		checkNumbers(t, ret, tt.structs)
+	}
+}
+
+// checkNumbers checks that ret holds the given ints, with nil meaning Lua nil.
+func checkNumbers(t *testing.T, ret LuaRet, expected []interface{}) {
+	if len(ret) != len(expected) {
+		t.Errorf("Expected %d values, got %d", len(expected), len(ret))
+		return
+	}
+	for i, exp := range expected {
+		if exp == nil {
+			if _, ok := ret[i].(LuaNil); !ok {
+				t.Errorf("[%d]: expected nil, got %v", i, ret[i])
+			}
+		} else if n, ok := ret[i].(LuaNumber); !ok || int(n) != exp.(int) {
+			t.Errorf("[%d]: expected %v, got %v", i, exp, ret[i])
+		}
+	}
+}
+
+func TestCall2(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function pair(n) return n * 2, "double" end
+function single() return 1 end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	n, s, err := Call2[int, string](l, "pair", 21)
+	if err != nil {
+		t.Fatal("Error calling 'pair':", err)
+	}
+	if n != 42 || s != "double" {
+		t.Errorf("Expected (42, 'double'), got (%d, '%s')", n, s)
+	}
+
+	if _, _, err := Call2[int, int](l, "pair", 21); err == nil {
+		t.Error("Expected an error for a type mismatch")
+	}
+	if _, _, err := Call2[int, string](l, "single"); err == nil {
+		t.Error("Expected an error for an arity mismatch")
+	}
+}
+
+type point struct {
+	X, Y int
+}
+
+func (p point) Sum(n int) int {
+	return p.X + p.Y + n
+}
+
+func (p point) Scale(n int) point {
+	return point{p.X * n, p.Y * n}
+}
+
+func TestCallStructMethods(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function sum(p)
+	return p:Sum(3)
+end
+function scaledSum(p)
+	p.X = 10
+	return p:Scale(2):Sum(0)
+end
+function sameMeta(a, b)
+	return getmetatable(a) == getmetatable(b)
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var n int
+	if ret, err := l.Call("sum", point{1, 2}); err != nil {
+		t.Error("Error calling 'sum':", err)
+	} else if err := ret.Unmarshal(&n); err != nil || n != 6 {
+		t.Errorf("Expected 6, got %d (err: %v)", n, err)
+	}
+
+	// methods are bound to the Go value, so changes made in Lua aren't seen
+	if ret, err := l.Call("scaledSum", point{1, 2}); err != nil {
+		t.Error("Error calling 'scaledSum':", err)
+	} else if err := ret.Unmarshal(&n); err != nil || n != 6 {
+		t.Errorf("Expected 6, got %d (err: %v)", n, err)
+	}
+
+	var same bool
+	if ret, err := l.Call("sameMeta", point{1, 2}, point{3, 4}); err != nil {
+		t.Error("Error calling 'sameMeta':", err)
+	} else if err := ret.Unmarshal(&same); err != nil || !same {
+		t.Error("Structs of the same type should share a metatable")
+	}
+}
+
+type tagged struct {
+	Tags []string
+	Meta interface{}
+}
+
+func (t tagged) Joined(sep string) string {
+	return strings.Join(t.Tags, sep)
+}
+
+func TestCallStructMethodsComplexFields(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function joined(v)
+	local first = v:Joined(",")
+	return first, v:Joined("+"), v.Joined == v.Joined
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("joined", tagged{Tags: []string{"a", "b"}, Meta: 1})
+	if err != nil {
+		t.Fatal("Error calling 'joined':", err)
+	}
+	if ret[0] != LuaString("a,b") || ret[1] != LuaString("a+b") {
+		t.Errorf("Expected 'a,b' and 'a+b', got %v and %v", ret[0], ret[1])
+	}
+	if ret[2] != LuaBool(true) {
+		t.Error("Expected the bound method to be cached")
+	}
+}
+
+func BenchmarkPushStructsWithMethods(b *testing.B) {
+	points := make([]point, 1000)
+	for i := range points {
+		points[i] = point{i, i}
+	}
+
+	l := New(NoLibs)
+	defer l.Close()
+
+	b.ResetTimer()
+	err := l.WithState(func(L *lua.State) error {
+		for i := 0; i < b.N; i++ {
+			if err := l.pushComplexType(points); err != nil {
+				return err
+			}
+			L.Pop(1)
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestAssertError(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	_, err := l.Load("assert(false, 'bad')")
+	var assertErr AssertError
+	if !errors.As(err, &assertErr) {
+		t.Fatal("Expected an AssertError, got:", err)
+	}
+	if assertErr.Message != "bad" {
+		t.Errorf("Expected message 'bad', got '%s'", assertErr.Message)
+	}
+
+	code := `
+function validate(n)
+	return assert(n > 0, "must be positive")
+end
+function crash()
+	local t = nil
+	return t.field
+end
+function caught()
+	pcall(assert, false, "ignored")
+	error("something else")
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var ok bool
+	if ret, err := l.Call("validate", 1); err != nil {
+		t.Error("Passing assert shouldn't fail:", err)
+	} else if err := ret.Unmarshal(&ok); err != nil || !ok {
+		t.Error("assert should return its arguments")
+	}
+
+	if _, err := l.Call("validate", -1); err != (AssertError{"must be positive"}) {
+		t.Error("Expected an AssertError, got:", err)
+	}
+
+	if _, err := l.Call("crash"); err == nil {
+		t.Error("Expected an error")
+	} else if errors.As(err, &assertErr) {
+		t.Error("Runtime errors shouldn't be AssertErrors:", err)
+	}
+
+	if _, err := l.Call("caught"); err == nil {
+		t.Error("Expected an error")
+	} else if errors.As(err, &assertErr) {
+		t.Error("A caught assert shouldn't turn later errors into AssertErrors:", err)
+	}
+}
+
+func TestEmitter(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+received = {}
+function setup(e)
+	e:on(function(v) received[#received + 1] = v end)
+	e:on(function(v)
+		if v == "first" then error("bad event") end
+	end)
+end
+function count()
+	return #received, received[1], received[2]
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ch := make(chan interface{}, 2)
+	e, err := l.PushEmitter(ch)
+	if err != nil {
+		t.Fatal("Error creating emitter:", err)
+	}
+	if _, err := l.Call("setup", e); err != nil {
+		t.Fatal("Error calling 'setup':", err)
+	}
+
+	ch <- "first"
+	ch <- "second"
+	err = l.Pump()
+	if err == nil || !strings.Contains(err.Error(), "bad event") {
+		t.Error("Expected the failing callback's error from Pump, got:", err)
+	}
+	var lerr *LunaError
+	if !errors.As(err, &lerr) || lerr.Line != 6 {
+		t.Errorf("Expected a *LunaError from line 6, got %#v", err)
+	}
+
+	ret, err := l.Call("count")
+	if err != nil {
+		t.Fatal("Error calling 'count':", err)
+	}
+	var n int
+	var first, second string
+	if err := ret.Unmarshal(&n, &first, &second); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if n != 2 || first != "first" || second != "second" {
+		t.Errorf("Expected both events to be received, got %d: '%s', '%s'", n, first, second)
+	}
+
+	close(ch)
+	if err := l.Pump(); err != nil {
+		t.Error("Pumping a closed emitter shouldn't fail:", err)
+	}
+
+	other := make(chan interface{}, 1)
+	e, err = l.PushEmitter(other)
+	if err != nil {
+		t.Fatal("Error creating emitter:", err)
+	}
+	if _, err := l.Call("setup", e); err != nil {
+		t.Fatal("Error calling 'setup':", err)
+	}
+	e.Release()
+	other <- "third"
+	if err := l.Pump(); err != nil {
+		t.Error("Pumping after a release shouldn't fail:", err)
+	}
+	if len(other) != 1 {
+		t.Error("Expected a released emitter not to be pumped")
+	}
+	if _, err := l.Call("setup", e); err == nil {
+		t.Error("Expected an error passing a released emitter")
+	}
+}
+
+func TestCallNilArguments(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load(`function args(...)
+				local a, b, c = ...
+				return select('#', ...), a, b == nil, c
+			end`); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var nilPtr *int
+	for _, middle := range []interface{}{nil, nilPtr} {
+		ret, err := l.Call("args", 1, middle, 3)
+		if err != nil {
+			t.Fatal("Error calling 'args':", err)
+		}
+
+		var n, a, c int
+		var bNil bool
+		if err := ret.Unmarshal(&n, &a, &bNil, &c); err != nil {
+			t.Fatal("Error unmarshalling return values:", err)
+		}
+		if n != 3 {
+			t.Errorf("Expected 3 arguments, got %d", n)
+		}
+		if a != 1 || !bNil || c != 3 {
+			t.Errorf("Arguments out of position: %d, %t, %d", a, bNil, c)
+		}
+	}
+}
+
+func TestUpvalues(t *testing.T) {
+	l := New(LibBase | LibDebug)
+	defer l.Close()
+	code := `
+local count = 10
+function counter()
+	count = count + 1
+	return count
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	val, err := l.GetUpvalue("counter", 1)
+	if err != nil {
+		t.Fatal("Error getting upvalue:", err)
+	}
+	if val != LuaNumber(10) {
+		t.Errorf("Expected upvalue of 10, got %v", val)
+	}
+
+	if err := l.SetUpvalue("counter", 1, 100); err != nil {
+		t.Fatal("Error setting upvalue:", err)
+	}
+	ret, err := l.Call("counter")
+	if err != nil {
+		t.Fatal("Error calling 'counter':", err)
+	}
+	var n int
+	if err := ret.Unmarshal(&n); err != nil || n != 101 {
+		t.Errorf("Expected 101 after setting the upvalue, got %d (err: %v)", n, err)
+	}
+
+	if _, err := l.GetUpvalue("counter", 5); err == nil {
+		t.Error("Expected an error getting an invalid upvalue")
+	}
+	if err := l.SetUpvalue("counter", 5, 1); err == nil {
+		t.Error("Expected an error setting an invalid upvalue")
+	}
+	if _, err := l.GetUpvalue("noexists", 1); err == nil {
+		t.Error("Expected an error getting an upvalue of a missing function")
+	}
+
+	noDebug := New(LibBase)
+	defer noDebug.Close()
+	if _, err := noDebug.GetUpvalue("counter", 1); err == nil {
+		t.Error("Expected an error without the debug library")
+	}
+}
+
+func TestLuaRetFirst(t *testing.T) {
+	var empty LuaRet
+	if !empty.IsEmpty() {
+		t.Error("Empty LuaRet should be empty")
+	}
+	if _, ok := empty.First().(LuaNil); !ok {
+		t.Errorf("First of an empty LuaRet should be LuaNil, got %T", empty.First())
+	}
+
+	ret := LuaRet{LuaString("first"), LuaNumber(2)}
+	if ret.IsEmpty() {
+		t.Error("Non-empty LuaRet shouldn't be empty")
+	}
+	if first := ret.First(); first != LuaString("first") {
+		t.Errorf("Expected 'first', got %v", first)
+	}
+}
+
+func TestMismatchedFields(t *testing.T) {
+	type Data struct {
+		A int
+		B string
+		C bool
+	}
+
+	var data Data
+	l := New(LibBase)
+	defer l.Close()
+	if err := l.CreateLibrary("testlib", TableKeyValue{"func", func(d Data) { data = d }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	if _, err := l.Load("function callMe() testlib.func({A=1, B=2, C=true}) end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	_, err := l.Call("callMe")
+	if err == nil || !strings.Contains(err.Error(), "bad argument #1 to 'testlib.func' (Cannot assign Lua number to Go string (field B))") {
+		t.Error("Expected a detailed type error, got:", err)
+	}
+
+	l.SkipMismatchedFields = true
+	if _, err := l.Call("callMe"); err != nil {
+		t.Fatal("Mismatched fields should be skipped:", err)
+	}
+	if expected := (Data{A: 1, C: true}); data != expected {
+		t.Errorf("Expected: %+v, Actual: %+v", expected, data)
+	}
+
+	var buf bytes.Buffer
+	l.MismatchedFields = LogMismatchedFields(log.New(&buf, "", 0))
+	if _, err := l.Call("callMe"); err != nil {
+		t.Fatal("Logged fields shouldn't fail:", err)
+	}
+	if !strings.Contains(buf.String(), "Skipping field: Cannot assign Lua number to Go string (field B)") {
+		t.Errorf("Expected the skipped field to be logged, got: %q", buf.String())
+	}
+}
+
+type myKey string
+
+func TestCallNamedMapKeys(t *testing.T) {
+	type id int
+
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function get(m, ids) return m.apples, m.pears, ids[7] end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("get", map[myKey]int{"apples": 3, "pears": 5}, map[id]string{7: "seven"})
+	if err != nil {
+		t.Fatal("Error calling 'get':", err)
+	}
+
+	var apples, pears int
+	var seven string
+	if err := ret.Unmarshal(&apples, &pears, &seven); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if apples != 3 || pears != 5 || seven != "seven" {
+		t.Errorf("Unexpected values: %d, %d, '%s'", apples, pears, seven)
+	}
+
+	if _, err := l.Call("get", map[struct{ A int }]int{{1}: 1}, nil); err == nil {
+		t.Error("Expected an error pushing a map with struct keys")
+	}
+}
+
+type account struct {
+	Owner   string
+	balance int
+}
+
+func (a *account) SetBalance(b int) error {
+	if b < 0 {
+		return fmt.Errorf("negative balance: %d", b)
+	}
+	a.balance = b
+	return nil
+}
+
+func TestSetters(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	ret, err := l.Load("return {owner = 'luna', balance = 10}, {balance = -1}")
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var acct account
+	if err := ret[0].Unmarshal(&acct); err != nil {
+		t.Fatal("Error unmarshalling:", err)
+	}
+	if acct.balance != 0 {
+		t.Error("Setters shouldn't be used by default")
+	}
+
+	opts := UnmarshalOptions{UseSetters: true}
+	if err := opts.Unmarshal(ret[0], &acct); err != nil {
+		t.Fatal("Error unmarshalling with setters:", err)
+	}
+	if acct.Owner != "luna" || acct.balance != 10 {
+		t.Errorf("Expected owner 'luna' with balance 10, got %+v", acct)
+	}
+
+	var got account
+	if err := l.CreateLibrary("testlib", TableKeyValue{"func", func(a account) { got = a }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	l.UseSetters = true
+	if _, err := l.Load("testlib.func({owner = 'lib', balance = 20})"); err != nil {
+		t.Fatal("Error calling function with setters:", err)
+	}
+	if got.Owner != "lib" || got.balance != 20 {
+		t.Errorf("Expected owner 'lib' with balance 20, got %+v", got)
+	}
+
+	if _, err := l.Load("testlib.func({balance = -1})"); err == nil {
+		t.Error("Expected the setter's error to be returned")
+	}
+}
+
+func TestLastCallDuration(t *testing.T) {
+	l := New(LibBase | LibOS)
+	defer l.Close()
+	code := `
+function spin(ms)
+	local start = os.clock()
+	while os.clock() - start < ms / 1000 do end
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	if d := l.LastCallDuration(); d != 0 {
+		t.Error("Duration should be zero before any calls:", d)
+	}
+	if _, err := l.Call("spin", 20); err != nil {
+		t.Fatal("Error calling 'spin':", err)
+	}
+	if d := l.LastCallDuration(); d < 10*time.Millisecond {
+		t.Error("Duration should cover the script's run time:", d)
+	}
+}
+
+func TestMessageHandler(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function fail(msg) error(msg, 0) end function echo(...) return ... end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	handler := func(msg string) string {
+		return "[handled] " + msg
+	}
+	if err := l.SetMessageHandler(handler); err != nil {
+		t.Fatal("Error setting message handler:", err)
+	}
+
+	if _, err := l.Call("fail", "boom"); err == nil || err.Error() != "[handled] boom" {
+		t.Error("Expected the handler to prefix the error, got:", err)
+	}
+	if _, err := l.Load("error('loading', 0)"); err == nil || err.Error() != "[handled] loading" {
+		t.Error("Expected the handler to prefix the load error, got:", err)
+	}
+
+	// arguments and return values pass through the handler unchanged
+	ret, err := l.Call("echo", 1, nil, "three")
+	if err != nil {
+		t.Fatal("Error calling 'echo':", err)
+	}
+	if len(ret) != 3 {
+		t.Errorf("Expected 3 return values, got %d", len(ret))
+	}
+
+	if err := l.SetMessageHandler(nil); err != nil {
+		t.Fatal("Error removing message handler:", err)
+	}
+	if _, err := l.Call("fail", "boom"); err == nil || err.Error() != "boom" {
+		t.Error("Expected the original error after removing the handler, got:", err)
+	}
+}
+
+func TestMessageHandlerNoLibs(t *testing.T) {
+	l := New(NoLibs)
+	defer l.Close()
+	err := l.SetMessageHandler(func(msg string) string { return msg })
+	if err == nil || !strings.Contains(err.Error(), "xpcall") {
+		t.Error("Expected an error naming xpcall, got:", err)
+	}
+	if _, err := l.Load("x = 1"); err != nil {
+		t.Error("Expected code to run without the handler, got:", err)
+	}
+}
+
+func TestReentrantCall(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function double(x) return x * 2 end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var callErr error
+	double := func(x int) int {
+		ret, err := l.Call("double", x)
+		if err != nil {
+			callErr = err
+			return 0
+		}
+		var y int
+		if err := ret.Unmarshal(&y); err != nil {
+			callErr = err
+		}
+		return y
+	}
+	quadruple := func(x int) int {
+		return double(double(x))
+	}
+	define := func(src string) {
+		if _, err := l.Load(src); err != nil {
+			callErr = err
+		}
+	}
+	err := l.CreateLibrary("testlib", TableKeyValue{"quadruple", quadruple}, TableKeyValue{"define", define})
+	if err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+
+	if _, err := l.Load("testlib.define('function triple(x) return x * 3 end')"); err != nil || callErr != nil {
+		t.Fatal("Error loading from Lua:", err, callErr)
+	}
+	ret, err := l.Call("triple", 2)
+	if err != nil {
+		t.Fatal("Error calling function defined from Lua:", err)
+	}
+	var n int
+	if err := ret.Unmarshal(&n); err != nil || n != 6 {
+		t.Error("Expected triple(2) to return 6, got:", n, err)
+	}
+
+	ret, err = l.Load("return 1 + testlib.quadruple(3)")
+	if err != nil || callErr != nil {
+		t.Fatal("Error calling back into Lua:", err, callErr)
+	}
+	if err := ret.Unmarshal(&n); err != nil || n != 13 {
+		t.Error("Expected 13, got:", n, err)
+	}
+}
+
+func TestOnWorker(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	var inside bool
+	if err := l.CreateLibrary("testlib", TableKeyValue{"check", func() { inside = l.onWorker() }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	if l.onWorker() {
+		t.Error("Expected the test goroutine not to be the worker")
+	}
+	if _, err := l.Load(`testlib.check()`); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	if !inside {
+		t.Error("Expected a Go function called by Lua to be on the worker")
+	}
+	if l.onWorker() {
+		t.Error("Expected the test goroutine not to be the worker after a call")
+	}
+}
+
+func BenchmarkLock(b *testing.B) {
+	l := New(LibBase)
+	defer l.Close()
+	for i := 0; i < b.N; i++ {
+		l.lock()()
+	}
+}
+
+func TestLuaValueString(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(`return 2.5, 3, "hi", true, nil, {1, 2, x="a", [5]=true, [true]=3, nested={y=1}}`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	expected := []string{
+		"2.5",
+		"3",
+		"hi",
+		"true",
+		"nil",
+		`{1, 2, [5]=true, nested={y=1}, x="a", [true]=3}`,
+	}
+	if len(ret) != len(expected) {
+		t.Fatalf("Expected %d return values, got %d", len(expected), len(ret))
+	}
+	for i, v := range ret {
+		if s := fmt.Sprint(v); s != expected[i] {
+			t.Errorf("Value %d: expected '%s', got '%s'", i, expected[i], s)
+		}
+	}
+}
+
+func TestRounding(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function frac() return 2.7 end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	tests := []struct {
+		rounding Rounding
+		expected int
+		fails    bool
+	}{
+		{Truncate, 2, false},
+		{RoundNearest, 3, false},
+		{RejectFractions, 0, true},
+	}
+	for _, test := range tests {
+		// set, through a Go function called from Lua
+		var got int
+		l.Rounding = test.rounding
+		err := l.CreateLibrary("testlib", TableKeyValue{"store", func(i int) { got = i }})
+		if err != nil {
+			t.Fatal("Error creating library:", err)
+		}
+		_, err = l.Load("testlib.store(frac())")
+		if test.fails != (err != nil) {
+			t.Errorf("Rounding %d: unexpected error from set: %v", test.rounding, err)
+		}
+		if got != test.expected {
+			t.Errorf("Rounding %d: expected set to give %d, got %d", test.rounding, test.expected, got)
+		}
+
+		// convertBasic, through UnmarshalOptions
+		ret, err := l.Call("frac")
+		if err != nil {
+			t.Fatal("Error calling 'frac':", err)
+		}
+		var i int
+		err = UnmarshalOptions{Rounding: test.rounding}.Unmarshal(ret[0], &i)
+		if test.fails != (err != nil) {
+			t.Errorf("Rounding %d: unexpected error from Unmarshal: %v", test.rounding, err)
+		}
+		if i != test.expected {
+			t.Errorf("Rounding %d: expected Unmarshal to give %d, got %d", test.rounding, test.expected, i)
+		}
+	}
+}
+
+func TestPendingCalls(t *testing.T) {
+	l := New(LibOS)
+	defer l.CloseWait()
+	l.CallTimeout = time.Millisecond
+	if _, err := l.Load("function block() os.execute('sleep .1') end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	if n := l.PendingCalls(); n != 0 {
+		t.Error("Expected no pending calls before calling, got:", n)
+	}
+	if _, err := l.Call("block"); err == nil {
+		t.Fatal("Expected the call to time out")
+	}
+	if n := l.PendingCalls(); n != 1 {
+		t.Error("Expected the timed out call to be pending, got:", n)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for l.PendingCalls() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := l.PendingCalls(); n != 0 {
+		t.Error("Expected no pending calls once the call finished, got:", n)
+	}
+}
+
+func TestPushInterfaceFields(t *testing.T) {
+	type Celsius float64
+	type Inner struct {
+		Name  string
+		Extra interface{}
+	}
+	type Outer struct {
+		Struct  interface{}
+		Pointer interface{}
+		Slice   interface{}
+		Map     interface{}
+		Named   interface{}
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function check(o)
+	return o.Struct.Name, o.Struct.Extra.key, o.Pointer.Name, o.Slice[2], o.Map.a, o.Named
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	arg := Outer{
+		Struct:  Inner{Name: "value", Extra: map[string]interface{}{"key": 5}},
+		Pointer: &Inner{Name: "pointer"},
+		Slice:   []interface{}{1, Inner{}},
+		Map:     map[string]interface{}{"a": "b"},
+		Named:   Celsius(21.5),
+	}
+	ret, err := l.Call("check", arg)
+	if err != nil {
+		t.Fatal("Error calling 'check':", err)
+	}
+
+	var (
+		name, pointer, a string
+		key              int
+		elem             Inner
+		named            Celsius
+	)
+	if err := ret.Unmarshal(&name, &key, &pointer, &elem, &a, &named); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if name != "value" || key != 5 || pointer != "pointer" || a != "b" || named != 21.5 {
+		t.Error("Interface fields not pushed as their concrete values:", name, key, pointer, a, named)
+	}
+}
+
+func TestFreezeGlobals(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("existing = 1"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	l.FreezeGlobals()
+
+	if _, err := l.Load("x = 1"); err == nil {
+		t.Error("Expected an error creating a global after freezing")
+	} else if !strings.Contains(err.Error(), "Cannot create global 'x'") {
+		t.Error("Unexpected error creating a global:", err)
+	}
+	if _, err := l.Load("function f() end"); err == nil {
+		t.Error("Expected an error defining a global function after freezing")
+	}
+	if _, err := l.Load("local x = 1; local function f() return x end; return f()"); err != nil {
+		t.Error("Locals should still work after freezing:", err)
+	}
+	if _, err := l.Load("existing = 2"); err != nil {
+		t.Error("Existing globals should still be assignable after freezing:", err)
+	}
+}
+
+type wideStruct struct {
+	F1, F2, F3, F4, F5, F6, F7, F8, F9, F10          int
+	F11, F12, F13, F14, F15, F16, F17, F18, F19, F20 string
+}
+
+const wideTableSrc = `
+local t = {}
+for i = 1, 10 do t["F" .. i] = i end
+for i = 11, 20 do t["F" .. i] = "v" .. i end
+return t`
+
+func TestUnmarshalInto(t *testing.T) {
+	type Base struct {
+		ID int
+	}
+	type Data struct {
+		*Base
+		Name  string
+		Tags  []string
+		Inner struct{ X int }
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(`return {ID=1, Name="name", Tags={"a", "b"}, Inner={X=2}}`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	table, ok := ret[0].(LuaTable)
+	if !ok {
+		t.Fatalf("Expected a table, got %T", ret[0])
+	}
+
+	var expected, got Data
+	if err := table.Unmarshal(&expected); err != nil {
+		t.Fatal("Error unmarshalling table:", err)
+	}
+	// twice, so the second time uses the cached index
+	for i := 0; i < 2; i++ {
+		if err := table.UnmarshalInto(&got); err != nil {
+			t.Fatal("Error unmarshalling table with cached fields:", err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, got)
+		}
+	}
+}
+
+func benchmarkWideStruct(b *testing.B, unmarshal func(LuaTable, *wideStruct) error) {
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(wideTableSrc)
+	if err != nil {
+		b.Fatal("Error loading test code:", err)
+	}
+	table := ret[0].(LuaTable)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var w wideStruct
+		if err := unmarshal(table, &w); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalWideStruct(b *testing.B) {
+	benchmarkWideStruct(b, func(t LuaTable, w *wideStruct) error {
+		return t.Unmarshal(w)
+	})
+}
+
+func BenchmarkUnmarshalIntoWideStruct(b *testing.B) {
+	benchmarkWideStruct(b, func(t LuaTable, w *wideStruct) error {
+		return t.UnmarshalInto(w)
+	})
+}
+
+func TestRegisterErrors(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if err := l.RegisterErrors(io.EOF); err != nil {
+		t.Fatal("Error registering errors:", err)
+	}
+	err := l.CreateLibrary("ctx",
+		TableKeyValue{"EOF", io.EOF},
+		TableKeyValue{"read", func() error { return io.EOF }},
+		TableKeyValue{"isEOF", func(err error) bool { return err == io.EOF }},
+	)
+	if err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+
+	ret, err := l.Load("local err = ctx.read() return err == ctx.EOF, tostring(err), ctx.isEOF(err), err")
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	var (
+		same, isEOF bool
+		msg         string
+		back        error
+	)
+	if err := ret.Unmarshal(&same, &msg, &isEOF, &back); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if !same {
+		t.Error("Pushing the same error twice should give the same Lua value")
+	}
+	if msg != io.EOF.Error() {
+		t.Errorf("Expected tostring() to give '%s', got '%s'", io.EOF, msg)
+	}
+	if !isEOF || back != io.EOF {
+		t.Error("Expected the registered error to come back as io.EOF:", isEOF, back)
+	}
+}
+
+func TestCompiledChunk(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	chunk, err := l.Compile("math", "function add(a, b) return a + b end return 'loaded'")
+	if err != nil {
+		t.Fatal("Error compiling chunk:", err)
+	}
+	if len(chunk.Bytes()) == 0 {
+		t.Fatal("Compiled chunk is empty")
+	}
+	if l.FunctionExists("add") {
+		t.Error("Compiling shouldn't run the chunk")
+	}
+
+	ret, err := l.Run(chunk)
+	if err != nil {
+		t.Fatal("Error running chunk:", err)
+	}
+	var s string
+	if err := ret.Unmarshal(&s); err != nil || s != "loaded" {
+		t.Error("Expected the chunk to return 'loaded', got:", s, err)
+	}
+
+	var sum int
+	if ret, err := l.Call("add", 2, 3); err != nil {
+		t.Fatal("Error calling function defined by chunk:", err)
+	} else if err := ret.Unmarshal(&sum); err != nil || sum != 5 {
+		t.Error("Expected add(2, 3) to return 5, got:", sum, err)
+	}
+
+	// the same chunk can be run in another state
+	other := New(LibBase)
+	defer other.Close()
+	ret, err = other.RunAndCall(chunk, "add", 4, 5)
+	if err != nil {
+		t.Fatal("Error running and calling chunk:", err)
+	}
+	if err := ret.Unmarshal(&sum); err != nil || sum != 9 {
+		t.Error("Expected add(4, 5) to return 9, got:", sum, err)
+	}
+
+	if _, err := l.Compile("broken", "function ("); err == nil {
+		t.Error("Expected an error compiling invalid code")
+	}
+}
+
+func TestRunChunkArgs(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	chunk, err := l.Compile("scale", "local n, factor = ... return n * factor")
+	if err != nil {
+		t.Fatal("Error compiling chunk:", err)
+	}
+	for i := 1; i <= 3; i++ {
+		ret, err := chunk.Run(i, 10)
+		if err != nil {
+			t.Fatal("Error running chunk:", err)
+		}
+		if ret.First() != LuaNumber(i*10) {
+			t.Errorf("Expected %d, got %v", i*10, ret.First())
+		}
+	}
+}
+
+const benchSrc = "local n = ... or 100 local total = 0 for i = 1, n do total = total + i end return total"
+
+func BenchmarkLoadRepeated(b *testing.B) {
+	l := New(LibBase)
+	defer l.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := l.Load(benchSrc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRunCompiled(b *testing.B) {
+	l := New(LibBase)
+	defer l.Close()
+	chunk, err := l.Compile("bench", benchSrc)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := chunk.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// vec2 decodes from an array {x, y} instead of a table of fields.
+type vec2 struct {
+	X, Y int
+}
+
+func (p *vec2) UnmarshalLua(lv LuaValue) error {
+	var xy [2]int
+	if err := lv.Unmarshal(&xy); err != nil {
+		return err
+	}
+	p.X, p.Y = xy[0], xy[1]
+	return nil
+}
+
+// tagSet decodes from an array of strings, using a value receiver.
+type tagSet map[string]bool
+
+func (t tagSet) UnmarshalLua(lv LuaValue) error {
+	var tags []string
+	if err := lv.Unmarshal(&tags); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		t[tag] = true
+	}
+	return nil
+}
+
+// upper decodes from a string, upper-casing it.
+type upper string
+
+func (u *upper) UnmarshalLua(lv LuaValue) error {
+	var s string
+	if err := lv.Unmarshal(&s); err != nil {
+		return err
+	}
+	*u = upper(strings.ToUpper(s))
+	return nil
+}
+
+func TestLuaUnmarshaler(t *testing.T) {
+	type shape struct {
+		Origin vec2
+		Path   []vec2
+		Name   upper
+		Tags   tagSet
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(`return {Origin={1, 2}, Path={{3, 4}, {5, 6}}, Name="square", Tags={"a", "b"}}, {7, 8}`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	s := shape{Tags: tagSet{}}
+	var p vec2
+	if err := ret.Unmarshal(&s, &p); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	expected := shape{
+		Origin: vec2{1, 2},
+		Path:   []vec2{{3, 4}, {5, 6}},
+		Name:   "SQUARE",
+		Tags:   tagSet{"a": true, "b": true},
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, s)
+	}
+	if p != (vec2{7, 8}) {
+		t.Error("Expected {7 8}, got:", p)
+	}
+}
+
+// money is pushed to Lua as a formatted string.
+type money struct {
+	Cents int64
+}
+
+func (m money) MarshalLua() (LuaValue, error) {
+	return LuaString(fmt.Sprintf("$%d.%02d", m.Cents/100, m.Cents%100)), nil
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalLua() (LuaValue, error) {
+	return nil, errors.New("Can't marshal")
+}
+
+func TestLuaMarshaler(t *testing.T) {
+	type invoice struct {
+		Total money
+		Items []money
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function describe(inv, m) return inv.Total .. ' for ' .. inv.Items[1] .. ' and ' .. inv.Items[2], type(m) end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("describe", invoice{money{1234}, []money{{1000}, {234}}}, &money{5})
+	if err != nil {
+		t.Fatal("Error calling 'describe':", err)
+	}
+	var desc, typ string
+	if err := ret.Unmarshal(&desc, &typ); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if desc != "$12.34 for $10.00 and $2.34" {
+		t.Error("Unexpected description:", desc)
+	}
+	if typ != "string" {
+		t.Error("Expected a pointer to be marshalled as a string, got:", typ)
+	}
+
+	if _, err := l.Call("describe", badMarshaler{}); err == nil || err.Error() != "Can't marshal" {
+		t.Error("Expected the MarshalLua error, got:", err)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	var greeted string
+	env := l.NewEnv(true)
+	err := l.CreateLibraryIn(env, "host", TableKeyValue{"greet", func(name string) { greeted = name }})
+	if err != nil {
+		t.Fatal("Error creating library in env:", err)
+	}
+	if err := l.SetGlobalIn(env, "user", "gopher"); err != nil {
+		t.Fatal("Error setting global in env:", err)
+	}
+
+	ret, err := l.LoadIn(env, "host.greet(user) created = true return type(print)")
+	if err != nil {
+		t.Fatal("Error loading code in env:", err)
+	}
+	if greeted != "gopher" {
+		t.Error("Library in env not called with the env's global:", greeted)
+	}
+	var typ string
+	if err := ret.Unmarshal(&typ); err != nil || typ != "function" {
+		t.Error("Expected the env to inherit the real globals, got:", typ, err)
+	}
+
+	ret, err = l.Load("return host, user, created")
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	for i, v := range ret {
+		if _, ok := v.(LuaNil); !ok {
+			t.Errorf("Real global %d should be untouched, got: %v", i, v)
+		}
+	}
+
+	isolated := l.NewEnv(false)
+	if _, err := l.LoadIn(isolated, "print('hi')"); err == nil {
+		t.Error("Expected an error using a standard library function in an isolated env")
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	type Config struct {
+		Name  string
+		Limit int
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	if err := l.SetGlobal("config", Config{"test", 3}); err != nil {
+		t.Fatal("Error setting global:", err)
+	}
+	if _, err := l.Load("result = config.Name .. config.Limit"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	val, err := l.GetGlobal("result")
+	if err != nil {
+		t.Fatal("Error getting global:", err)
+	}
+	var result string
+	if err := val.Unmarshal(&result); err != nil || result != "test3" {
+		t.Error("Expected 'test3', got:", result, err)
+	}
+
+	val, err = l.GetGlobal("config")
+	if err != nil {
+		t.Fatal("Error getting global:", err)
+	}
+	var cfg Config
+	if err := val.Unmarshal(&cfg); err != nil || cfg != (Config{"test", 3}) {
+		t.Error("Expected the config to round trip, got:", cfg, err)
+	}
+
+	if val, err := l.GetGlobal("missing"); err != nil {
+		t.Error("Error getting missing global:", err)
+	} else if _, ok := val.(LuaNil); !ok {
+		t.Error("Expected nil for a missing global, got:", val)
+	}
+	if _, err := l.GetGlobal("print"); err == nil {
+		t.Error("Expected an error getting a function")
+	}
+}
+
+func TestNotInitialized(t *testing.T) {
+	var l Luna
+	if _, err := l.Call("fn"); err != ErrNotInitialized {
+		t.Error("Expected ErrNotInitialized from Call, got:", err)
+	}
+	if err := l.CallVoid("fn"); err != ErrNotInitialized {
+		t.Error("Expected ErrNotInitialized from CallVoid, got:", err)
+	}
+	if _, err := l.Load("x = 1"); err != ErrNotInitialized {
+		t.Error("Expected ErrNotInitialized from Load, got:", err)
+	}
+	if err := l.SetGlobal("x", 1); err != ErrNotInitialized {
+		t.Error("Expected ErrNotInitialized from SetGlobal, got:", err)
+	}
+	if l.FunctionExists("fn") {
+		t.Error("No function should exist without a state")
+	}
+	l.Close()
+
+	closed := New(LibBase)
+	closed.CloseWait()
+	if _, err := closed.Load("x = 1"); err != ErrNotInitialized {
+		t.Error("Expected ErrNotInitialized after closing, got:", err)
+	}
+	// closing again is harmless
+	closed.CloseWait()
+}
+
+func TestVarargs(t *testing.T) {
+	luaType := func(v LuaValue) string {
+		switch v.(type) {
+		case LuaNumber:
+			return "number"
+		case LuaString:
+			return "string"
+		case LuaBool:
+			return "boolean"
+		case LuaTable:
+			return "table"
+		case LuaNil:
+			return "nil"
+		}
+		return "unknown"
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	err := l.CreateLibrary("testlib",
+		TableKeyValue{"types", func(prefix string, args Varargs) string {
+			var types []string
+			for _, arg := range args {
+				types = append(types, luaType(arg))
+			}
+			return prefix + strings.Join(types, ",")
+		}},
+		TableKeyValue{"count", func(args ...LuaValue) int {
+			return len(args)
+		}},
+	)
+	if err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+
+	ret, err := l.Load("return testlib.types('types: ', 1, 'two', true, {}, nil, 6), testlib.types('none'), testlib.count(1, 'a', {})")
+	if err != nil {
+		t.Fatal("Error calling functions with varargs:", err)
+	}
+	var all, none string
+	var count int
+	if err := ret.Unmarshal(&all, &none, &count); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if all != "types: number,string,boolean,table,nil,number" {
+		t.Error("Unexpected types:", all)
+	}
+	if none != "none" {
+		t.Error("Expected no varargs, got:", none)
+	}
+	if count != 3 {
+		t.Error("Expected 3 variadic LuaValues, got:", count)
+	}
+}
+
+type wallet struct {
+	Owner   string
+	Balance int
+	Tags    []string
+}
+
+func (a *wallet) Deposit(n int) int {
+	a.Balance += n
+	return a.Balance
+}
+
+func TestPushPointer(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function update(acct)
+	acct.Balance = acct.Balance + 10
+	acct.Owner = acct.Owner .. "!"
+	return acct:Deposit(5), acct.Tags[2], acct.Missing
+end
+function identity(acct) return acct end
+function setMissing(acct) acct.Missing = 1 end
+function badSelf(acct)
+	local mt = getmetatable(acct)
+	local ok1, err1 = pcall(mt.__index, 1, "Owner")
+	local ok2, err2 = pcall(mt.__newindex, {}, "Owner", "x")
+	return ok1, err1, ok2, err2
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	acct := &wallet{Owner: "gopher", Balance: 100, Tags: []string{"a", "b"}}
+	ret, err := l.Call("update", acct)
+	if err != nil {
+		t.Fatal("Error calling 'update':", err)
+	}
+	var balance int
+	var tag string
+	var missing map[string]int
+	if err := ret.Unmarshal(&balance, &tag, &missing); err != nil {
+		t.Fatal("Error unmarshalling return values:", err)
+	}
+	if balance != 115 || acct.Balance != 115 {
+		t.Errorf("Expected Lua to change the Go value's balance to 115, got %d (returned %d)", acct.Balance, balance)
+	}
+	if acct.Owner != "gopher!" {
+		t.Error("Expected Lua to change the Go value's owner, got:", acct.Owner)
+	}
+	if tag != "b" || missing != nil {
+		t.Error("Unexpected field values:", tag, missing)
+	}
+
+	// the same pointer comes back
+	ret, err = l.Call("identity", acct)
+	if err != nil {
+		t.Fatal("Error calling 'identity':", err)
+	}
+	var back *wallet
+	if err := ret.Unmarshal(&back); err != nil || back != acct {
+		t.Error("Expected the original pointer back, got:", back, err)
+	}
+
+	if _, err := l.Call("setMissing", acct); err == nil {
+		t.Error("Expected an error setting a field that doesn't exist")
+	}
+	// the metamethods refuse to run on anything but the userdata
+	ret, err = l.Call("badSelf", acct)
+	if err != nil {
+		t.Fatal("Error calling 'badSelf':", err)
+	}
+	if len(ret) != 4 || ret[0] != LuaBool(false) || ret[2] != LuaBool(false) ||
+		!strings.Contains(fmt.Sprint(ret[1]), "bad self") || !strings.Contains(fmt.Sprint(ret[3]), "bad self") {
+		t.Error("Expected metamethods to reject a bad self, got:", ret)
+	}
+
+	if ret, err := l.Call("identity", (*wallet)(nil)); err != nil {
+		t.Error("Error calling 'identity' with nil:", err)
+	} else if _, ok := ret[0].(LuaNil); !ok {
+		t.Error("Expected a nil pointer to be pushed as nil, got:", ret[0])
+	}
+}
+
+func TestBoundMethods(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function valueCalls(p)
+	return p.Sum(1), p:Sum(1)
+end
+function pointerCalls(w)
+	w.Deposit(5)
+	w:Deposit(5)
+	return w.Balance
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var dot, colon int
+	if ret, err := l.Call("valueCalls", point{1, 2}); err != nil {
+		t.Error("Error calling 'valueCalls':", err)
+	} else if err := ret.Unmarshal(&dot, &colon); err != nil || dot != 4 || colon != 4 {
+		t.Errorf("Expected both call styles to return 4, got %d and %d (err: %v)", dot, colon, err)
+	}
+
+	w := &wallet{Balance: 1}
+	var balance int
+	if ret, err := l.Call("pointerCalls", w); err != nil {
+		t.Error("Error calling 'pointerCalls':", err)
+	} else if err := ret.Unmarshal(&balance); err != nil || balance != 11 {
+		t.Errorf("Expected a balance of 11, got %d (err: %v)", balance, err)
+	}
+	if w.Balance != 11 {
+		t.Error("Pointer receiver methods should change the Go value, got:", w.Balance)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(`return {1, "two", [10]=0.5, name="quote\"d\n", ["not an id"]=true, ["end"]=1, nested={list={1, 2}, empty={}}, [false]="no"}`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, ret[0]); err != nil {
+		t.Fatal("Error encoding table:", err)
+	}
+	expected := `{
+	1,
+	"two",
+	[10] = 0.5,
+	["end"] = 1,
+	name = "quote\"d\n",
+	nested = {
+		empty = {},
+		list = {
+			1,
+			2,
+		},
+	},
+	["not an id"] = true,
+	[false] = "no",
+}`
+	if buf.String() != expected {
+		t.Errorf("Unexpected encoding:\n%s", buf.String())
+	}
+
+	// the encoded table loads back as the same value
+	again, err := l.Load("return " + buf.String())
+	if err != nil {
+		t.Fatal("Error loading encoded table:", err)
+	}
+	if !reflect.DeepEqual(again[0], ret[0]) {
+		t.Errorf("Expected %v, got %v", ret[0], again[0])
+	}
+
+	if err := Encode(&buf, LuaPointer{&wallet{}}); err == nil {
+		t.Error("Expected an error encoding a pointer")
+	}
+}
+
+func TestLuaTableClone(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(`return {1, 2, name="orig", nested={x=1}}`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	orig := ret[0].(LuaTable)
+	before := orig.String()
+
+	clone := orig.Clone()
+	clone.Map()["name"] = LuaString("changed")
+	clone.Get("nested").(LuaTable).Map()["x"] = LuaNumber(2)
+	delete(clone.Map(), "nested")
+
+	if s := orig.String(); s != before {
+		t.Errorf("Changing the clone changed the original: %s != %s", s, before)
+	}
+	if s := clone.String(); s != `{1, 2, name="changed"}` {
+		t.Error("Unexpected clone:", s)
+	}
+}
+
+func TestStructTags(t *testing.T) {
+	type Tagged struct {
+		UserName string `luna:"user_name"`
+		Age      int
+		Secret   string `luna:"-"`
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function describe(t)
+	return t.user_name, t.UserName, t.Age, t.Secret
+end
+function make()
+	return {user_name="lua", Age=3, Secret="shh"}
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("describe", Tagged{"gopher", 5, "hidden"})
+	if err != nil {
+		t.Fatal("Error calling 'describe':", err)
+	}
+	var name string
+	var age int
+	if err := ret[0].Unmarshal(&name); err != nil || name != "gopher" {
+		t.Error("Expected the tag to name the field in Lua, got:", name, err)
+	}
+	if err := ret[2].Unmarshal(&age); err != nil || age != 5 {
+		t.Error("Expected untagged fields to keep their name, got:", age, err)
+	}
+	for _, i := range []int{1, 3} {
+		if _, ok := ret[i].(LuaNil); !ok {
+			t.Errorf("Value %d should not be pushed, got: %v", i, ret[i])
+		}
+	}
+
+	ret, err = l.Call("make")
+	if err != nil {
+		t.Fatal("Error calling 'make':", err)
+	}
+	var tagged, cached Tagged
+	if err := ret.Unmarshal(&tagged); err != nil {
+		t.Fatal("Error unmarshalling table:", err)
+	}
+	if tagged != (Tagged{UserName: "lua", Age: 3}) {
+		t.Error("Unexpected struct from table:", tagged)
+	}
+	if err := ret[0].(LuaTable).UnmarshalInto(&cached); err != nil || cached != tagged {
+		t.Error("Expected UnmarshalInto to honour tags too, got:", cached, err)
+	}
+
+	// through a Go function, which uses tableToStruct
+	var got Tagged
+	if err := l.CreateLibrary("testlib", TableKeyValue{"take", func(t Tagged) { got = t }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	if _, err := l.Load("testlib.take(make())"); err != nil {
+		t.Fatal("Error passing table to Go:", err)
+	}
+	if got != tagged {
+		t.Error("Expected tags to be honoured setting function arguments, got:", got)
+	}
+}
+
+func TestPrintNonStrings(t *testing.T) {
+	for _, libs := range []Lib{LibBase, NoLibs} {
+		c := new(stdout)
+		l := New(libs)
+		l.Stdout(c)
+		if _, err := l.Load("print(1, 2.5, true, nil, 'str') print()"); err != nil {
+			t.Fatal("Error printing non-strings:", err)
+		}
+		if len(*c) != 2 || (*c)[0] != "1\t2.5\ttrue\tnil\tstr\n" || (*c)[1] != "\n" {
+			t.Errorf("Unexpected output with libs %d: %q", libs, *c)
+		}
+		l.Close()
+	}
+
+	c := new(stdout)
+	l := New(LibBase)
+	defer l.Close()
+	l.Stdout(c)
+	code := `print({}, setmetatable({}, {__tostring = function() return "custom" end}))`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error printing tables:", err)
+	}
+	if len(*c) != 1 || !strings.HasPrefix((*c)[0], "table: ") || !strings.HasSuffix((*c)[0], "\tcustom\n") {
+		t.Errorf("Expected tables to be printed with tostring(), got: %q", *c)
+	}
+}
+
+func TestTostring(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load("return true, false, nil, 1, -2.5, 1e100, 1/0, -1/0, 'str'")
+	if err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+	expected := []string{"true", "false", "nil", "1", "-2.5", "1e+100", "inf", "-inf", "str"}
+	if len(ret) != len(expected) {
+		t.Fatal("Unexpected results:", ret)
+	}
+	for i, v := range ret {
+		if s := Tostring(v); s != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], s)
+		}
+	}
+	if s := Tostring(nil); s != "nil" {
+		t.Errorf("Expected a nil LuaValue to be \"nil\", got %q", s)
+	}
+
+	// Go's formatting agrees with Lua's own tostring()
+	c := new(stdout)
+	l.Stdout(c)
+	if _, err := l.Load("print(true, false, nil, 1/0)"); err != nil {
+		t.Fatal("Error printing:", err)
+	}
+	if len(*c) != 1 || (*c)[0] != "true\tfalse\tnil\tinf\n" {
+		t.Errorf("Unexpected output: %q", *c)
+	}
+}
+
+func TestStream(t *testing.T) {
+	// no io library, so scripts can only use the streams they're given
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function collect(r)
+	local lines = {}
+	for line in r:lines() do
+		lines[#lines + 1] = line
+	end
+	return lines, r:read()
+end
+function copy(r, w)
+	w:write(r:read(3), "|"):write(r:read("*a"), 42)
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	r, err := l.PushReader(strings.NewReader("one\ntwo\n\nthree"))
+	if err != nil {
+		t.Fatal("Error pushing reader:", err)
+	}
+	ret, err := l.Call("collect", r)
+	if err != nil {
+		t.Fatal("Error calling 'collect':", err)
+	}
+	var lines []string
+	if err := ret[0].Unmarshal(&lines); err != nil {
+		t.Fatal("Error unmarshalling lines:", err)
+	}
+	if !reflect.DeepEqual(lines, []string{"one", "two", "", "three"}) {
+		t.Errorf("Unexpected lines: %q", lines)
+	}
+	if _, ok := ret[1].(LuaNil); !ok {
+		t.Error("Expected nil reading past the end, got:", ret[1])
+	}
+
+	r, err = l.PushReader(strings.NewReader("abcdef"))
+	if err != nil {
+		t.Fatal("Error pushing reader:", err)
+	}
+	var buf bytes.Buffer
+	w, err := l.PushWriter(&buf)
+	if err != nil {
+		t.Fatal("Error pushing writer:", err)
+	}
+	if _, err := l.Call("copy", r, w); err != nil {
+		t.Fatal("Error calling 'copy':", err)
+	}
+	if buf.String() != "abc|def42" {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+
+	r.Release()
+	w.Release()
+	if _, err := l.Call("copy", r, w); err == nil {
+		t.Error("Expected an error passing released streams")
+	}
+}
+
+func TestUnmarshalInterfaceMap(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(`return {name="root", count=2, ok=true, list={1, "two", {x=3}}, nested={deep={1, y=2}}}`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var m map[string]interface{}
+	if err := ret.Unmarshal(&m); err != nil {
+		t.Fatal("Error unmarshalling into map[string]interface{}:", err)
+	}
+	expected := map[string]interface{}{
+		"name":  "root",
+		"count": float64(2),
+		"ok":    true,
+		"list":  []interface{}{float64(1), "two", map[string]interface{}{"x": float64(3)}},
+		"nested": map[string]interface{}{
+			"deep": map[string]interface{}{"1": float64(1), "y": float64(2)},
+		},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected %v, got %v", expected, m)
+	}
+
+	var v interface{}
+	if err := ret.Unmarshal(&v); err != nil {
+		t.Fatal("Error unmarshalling into interface{}:", err)
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("Expected %v, got %v", expected, v)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	type Data struct {
+		A int
+	}
+
+	var data Data
+	l := New(LibBase)
+	defer l.Close()
+	if err := l.CreateLibrary("testlib", TableKeyValue{"func", func(d Data) { data = d }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	if _, err := l.Load("function callMe() testlib.func({A=1, Extra=2}) end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	if _, err := l.Call("callMe"); err != nil || data.A != 1 {
+		t.Fatal("Unknown fields should be ignored by default:", data, err)
+	}
+
+	var buf bytes.Buffer
+	l.UnknownFields = LogUnknownFields(log.New(&buf, "", 0))
+	if _, err := l.Call("callMe"); err != nil {
+		t.Fatal("Logged fields shouldn't fail:", err)
+	}
+	if !strings.Contains(buf.String(), "Field Extra doesn't exist") {
+		t.Errorf("Expected the unknown field to be logged, got: %q", buf.String())
+	}
+
+	l.SetUnknownFieldPolicy(ErrorOnUnknownFields)
+	if _, err := l.Call("callMe"); err == nil || !strings.Contains(err.Error(), "Field Extra doesn't exist") {
+		t.Error("Expected an error for the unknown field, got:", err)
+	}
+}
+
+func TestMaxReturns(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function many(n)
+	local t = {}
+	for i = 1, n do t[i] = i end
+	return unpack(t)
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	l.MaxReturns = 100
+	if _, err := l.Call("many", 5000); err != MaxReturnsExceeded(100) {
+		t.Error("Expected MaxReturnsExceeded, got:", err)
+	}
+	if _, err := l.Load("return many(5000)"); err != MaxReturnsExceeded(100) {
+		t.Error("Expected MaxReturnsExceeded from Load, got:", err)
+	}
+
+	ret, err := l.Call("many", 100)
+	if err != nil {
+		t.Fatal("Returning up to MaxReturns values shouldn't fail:", err)
+	}
+	if len(ret) != 100 {
+		t.Error("Expected 100 return values, got:", len(ret))
+	}
+
+	l.MaxReturns = 0
+	if ret, err := l.Call("many", 5000); err != nil || len(ret) != 5000 {
+		t.Error("Expected no limit by default, got:", len(ret), err)
+	}
+}
+
+func TestUnmarshalResponse(t *testing.T) {
+	type Cookie struct {
+		Name  string
+		Value string
+	}
+	type Response struct {
+		Status  int               `luna:"status"`
+		Headers map[string]string `luna:"headers"`
+		Body    string            `luna:"body"`
+		Cookies []Cookie          `luna:"cookies"`
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function handle(path)
+	return {
+		status = 200,
+		headers = {["Content-Type"] = "text/plain", ["X-Path"] = path},
+		body = "hello",
+		cookies = {{name = "a", value = "1"}, {name = "b", value = "2"}},
+	}
+end
+function broken()
+	return {status = "ok"}
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("handle", "/index")
+	if err != nil {
+		t.Fatal("Error calling 'handle':", err)
+	}
+	var resp Response
+	if err := ret.Unmarshal(&resp); err != nil {
+		t.Fatal("Error unmarshalling response:", err)
+	}
+	expected := Response{
+		Status:  200,
+		Headers: map[string]string{"Content-Type": "text/plain", "X-Path": "/index"},
+		Body:    "hello",
+		Cookies: []Cookie{{"a", "1"}, {"b", "2"}},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, resp)
+	}
+
+	ret, err = l.Call("broken")
+	if err != nil {
+		t.Fatal("Error calling 'broken':", err)
+	}
+	if err := ret.Unmarshal(&resp); err == nil {
+		t.Error("Expected an error decoding a string into an int field")
+	}
+}
+
+func TestRegisterFuncWith(t *testing.T) {
+	div := func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return a / b, nil
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	if err := l.RegisterFuncWith("divAll", div, FuncOptions{Returns: PushAllResults}); err != nil {
+		t.Fatal("Error registering 'divAll':", err)
+	}
+	if err := l.RegisterFuncWith("divChecked", div, FuncOptions{Returns: TranslateErrors}); err != nil {
+		t.Fatal("Error registering 'divChecked':", err)
+	}
+
+	ret, err := l.Call("divAll", 4, 2)
+	if err != nil || len(ret) != 2 {
+		t.Fatal("Expected both results, got:", ret, err)
+	}
+	if _, ok := ret[1].(LuaNil); !ok {
+		t.Error("Expected a nil error, got:", ret[1])
+	}
+	if ret, err = l.Call("divAll", 1, 0); err != nil || len(ret) != 2 {
+		t.Fatal("Expected the error to be returned as a value, got:", ret, err)
+	} else if _, ok := ret[1].(LuaNil); ok {
+		t.Error("Expected a non-nil error value")
+	}
+
+	ret, err = l.Call("divChecked", 4, 2)
+	if err != nil || len(ret) != 1 {
+		t.Fatal("Expected only the result, got:", ret, err)
+	}
+	var n int
+	if err := ret.Unmarshal(&n); err != nil || n != 2 {
+		t.Errorf("Expected 2, got %d (err: %v)", n, err)
+	}
+	if _, err := l.Call("divChecked", 1, 0); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Error("Expected the error to be raised, got:", err)
+	}
+
+	if err := l.RegisterFuncWith("bad", 5, FuncOptions{}); err == nil {
+		t.Error("Expected an error registering a non-function")
+	}
+}
+
+func TestLuaTableKeys(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+local t = {"first", "second", name = "config", debug = true, [true] = "yes", [2.5] = "half"}
+local keys = {}
+for k in pairs(t) do
+	keys[#keys + 1] = k
+end
+return t, keys`
+	ret, err := l.Load(code)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	table := ret[0].(LuaTable)
+	keys := table.Keys()
+	expected := ret[1].(LuaTable).Slice()
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the order of pairs(), %v, got %v", expected, keys)
+	}
+
+	delete(table.Map(), "name")
+	for _, k := range table.Keys() {
+		if k == LuaString("name") {
+			t.Error("Deleted keys shouldn't be returned")
+		}
+	}
+	if n := len(table.Clone().Keys()); n != len(keys)-1 {
+		t.Errorf("Expected the clone to have %d keys, got %d", len(keys)-1, n)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("function forever() while true do end end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	// nothing is running, so this shouldn't affect the next script
+	l.Interrupt()
+	if _, err := l.Load("return 1"); err != nil {
+		t.Fatal("Interrupting while idle shouldn't stop later scripts:", err)
+	}
+
+	for _, run := range []func() error{
+		func() error { _, err := l.Call("forever"); return err },
+		func() error { _, err := l.Load("forever()"); return err },
+	} {
+		done := make(chan error)
+		go func() { done <- run() }()
+
+		time.Sleep(10 * time.Millisecond)
+		l.Interrupt()
+		select {
+		case err := <-done:
+			if err != ErrInterrupted {
+				t.Error("Expected ErrInterrupted, got:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Script wasn't interrupted")
+		}
+	}
+
+	if _, err := l.Load("return 1"); err != nil {
+		t.Error("State should be usable after interrupting a script:", err)
+	}
+}
+
+func TestTimeValues(t *testing.T) {
+	type Event struct {
+		At      time.Time
+		Timeout time.Duration
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	var got Event
+	if err := l.CreateLibrary("testlib", TableKeyValue{"take", func(e Event) { got = e }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	if _, err := l.Load("function get(e) testlib.take(e) return e.At, e.Timeout end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	event := Event{time.Date(2020, 5, 17, 12, 30, 0, 500000000, time.UTC), 1500 * time.Millisecond}
+	ret, err := l.Call("get", event)
+	if err != nil {
+		t.Fatal("Error calling 'get':", err)
+	}
+	if ret[0] != LuaNumber(1589718600.5) || ret[1] != LuaNumber(1.5e9) {
+		t.Error("Expected a Unix time and nanoseconds, got:", ret)
+	}
+	if !got.At.Equal(event.At) || got.Timeout != event.Timeout {
+		t.Errorf("Expected %+v to be passed back to Go, got %+v", event, got)
+	}
+
+	l.TimeEncoding = RFC3339Time
+	l.DurationEncoding = DurationSeconds
+	ret, err = l.Call("get", event)
+	if err != nil {
+		t.Fatal("Error calling 'get':", err)
+	}
+	if ret[0] != LuaString("2020-05-17T12:30:00.5Z") || ret[1] != LuaNumber(1.5) {
+		t.Error("Expected an RFC 3339 time and seconds, got:", ret)
+	}
+	if !got.At.Equal(event.At) || got.Timeout != event.Timeout {
+		t.Errorf("Expected %+v to be passed back to Go, got %+v", event, got)
+	}
+
+	if _, err := l.Load(`testlib.take({At = "2020-05-17T12:30:00Z", Timeout = "2m"})`); err != nil {
+		t.Fatal("Error passing strings as times:", err)
+	}
+	if !got.At.Equal(time.Date(2020, 5, 17, 12, 30, 0, 0, time.UTC)) || got.Timeout != 2*time.Minute {
+		t.Error("Unexpected times parsed from strings:", got)
+	}
+}
+
+func TestTrackGlobals(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("existing = 1 untouched = 2"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	l.TrackGlobals = true
+	if _, err := l.Load("existing = existing + 1 created = 'new' local notGlobal = 3"); err != nil {
+		t.Fatal("Error loading tracked code:", err)
+	}
+	expected := map[string]LuaValue{"existing": LuaNumber(2), "created": LuaString("new")}
+	if writes := l.LastWrites(); !reflect.DeepEqual(writes, expected) {
+		t.Errorf("Expected writes %v, got %v", expected, writes)
+	}
+	if created := l.LastCreated(); !reflect.DeepEqual(created, []string{"created"}) {
+		t.Error("Expected only 'created' to be created, got:", created)
+	}
+
+	ret, err := l.Load("return existing, created, untouched")
+	if err != nil {
+		t.Fatal("Error reading globals:", err)
+	}
+	if ret[0] != LuaNumber(2) || ret[1] != LuaString("new") || ret[2] != LuaNumber(2) {
+		t.Error("Expected tracked writes to change the real globals, got:", ret)
+	}
+	if writes := l.LastWrites(); len(writes) != 0 {
+		t.Error("Expected no writes from a script that only reads, got:", writes)
+	}
+}
+
+func TestByteSlices(t *testing.T) {
+	l := New(LibBase | LibString)
+	defer l.Close()
+	var got []byte
+	if err := l.CreateLibrary("testlib", TableKeyValue{"take", func(b []byte) { got = b }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	code := `
+function inspect(b)
+	testlib.take(b .. "!")
+	return type(b), #b, b:byte(2), b
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	blob := []byte{'a', 0, 255}
+	ret, err := l.Call("inspect", blob)
+	if err != nil {
+		t.Fatal("Error calling 'inspect':", err)
+	}
+	if ret[0] != LuaString("string") || ret[1] != LuaNumber(3) || ret[2] != LuaNumber(0) {
+		t.Error("Expected []byte to be pushed as a string, got:", ret)
+	}
+	var back []byte
+	if err := ret[3].Unmarshal(&back); err != nil || !bytes.Equal(back, blob) {
+		t.Errorf("Expected %q to be unmarshalled, got %q (err: %v)", blob, back, err)
+	}
+	if !bytes.Equal(got, []byte("a\x00\xff!")) {
+		t.Errorf("Expected the Go function to get the bytes, got %q", got)
+	}
+}
+
+func TestUnmarshalDuration(t *testing.T) {
+	type Config struct {
+		Timeout time.Duration
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	ret, err := l.Load(`return {Timeout = 5000000000}, {Timeout = "5s"}, "1m30s", {Timeout = "soon"}, {Timeout = 5}, 1136214245.5, "2006-01-02T15:04:05Z"`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		var c Config
+		if err := ret[i].Unmarshal(&c); err != nil || c.Timeout != 5*time.Second {
+			t.Errorf("Expected 5s from %v, got %v (err: %v)", ret[i], c.Timeout, err)
+		}
+	}
+	var d time.Duration
+	if err := ret[2].Unmarshal(&d); err != nil || d != 90*time.Second {
+		t.Errorf("Expected 1m30s, got %v (err: %v)", d, err)
+	}
+	var c Config
+	if err := ret[3].Unmarshal(&c); err == nil {
+		t.Error("Expected an error for an invalid duration")
+	}
+	opts := UnmarshalOptions{DurationEncoding: DurationSeconds}
+	if err := opts.Unmarshal(ret[4], &c); err != nil || c.Timeout != 5*time.Second {
+		t.Errorf("Expected 5s from seconds, got %v (err: %v)", c.Timeout, err)
+	}
+
+	want := time.Date(2006, 1, 2, 15, 4, 5, 5e8, time.UTC)
+	var tm time.Time
+	if err := ret[5].Unmarshal(&tm); err != nil || !tm.Equal(want) {
+		t.Errorf("Expected %v from Unix time, got %v (err: %v)", want, tm, err)
+	}
+	if err := ret[6].Unmarshal(&tm); err != nil || !tm.Equal(want.Truncate(time.Second)) {
+		t.Errorf("Expected time from RFC 3339 string, got %v (err: %v)", tm, err)
+	}
+}
+
+func TestUnmarshalDurationMatchesArgs(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	var arg time.Duration
+	if err := l.CreateLibrary("testlib", TableKeyValue{"take", func(d time.Duration) { arg = d }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	ret, err := l.Load(`testlib.take(1500000000) return 1500000000`)
+	if err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	var d time.Duration
+	if err := ret[0].Unmarshal(&d); err != nil || d != arg || d != 1500*time.Millisecond {
+		t.Errorf("Expected 1.5s from both paths, got %v and %v (err: %v)", d, arg, err)
+	}
+
+	l.DurationEncoding = DurationSeconds
+	if ret, err = l.Load(`testlib.take(1.5) return 1.5`); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	opts := UnmarshalOptions{DurationEncoding: DurationSeconds}
+	if err := opts.Unmarshal(ret[0], &d); err != nil || d != arg || d != 1500*time.Millisecond {
+		t.Errorf("Expected 1.5s from both paths in seconds, got %v and %v (err: %v)", d, arg, err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+count = 0
+function inc(n) count = count + n return count end
+function fail() error("failed") end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var results []LuaRet
+	var errs []error
+	err := l.Batch(func(b *Batch) {
+		for _, call := range []struct {
+			name string
+			args []interface{}
+		}{{"inc", []interface{}{1}}, {"fail", nil}, {"inc", []interface{}{2}}} {
+			ret, err := b.Call(call.name, call.args...)
+			results = append(results, ret)
+			errs = append(errs, err)
+		}
+	})
+	if err != nil {
+		t.Fatal("Error running batch:", err)
+	}
+
+	if errs[0] != nil || errs[2] != nil || errs[1] == nil {
+		t.Error("Expected only the second call to fail, got:", errs)
+	}
+	if results[0].First() != LuaNumber(1) || results[2].First() != LuaNumber(3) {
+		t.Error("Unexpected results:", results)
+	}
+
+	var closed Luna
+	if err := closed.Batch(func(*Batch) {}); err != ErrNotInitialized {
+		t.Error("Expected ErrNotInitialized, got:", err)
+	}
+}
+
+func TestLuaFunctionFinalizer(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load(`return function() end, {f = function() end}`); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	queued := func() int {
+		l.unrefMut.Lock()
+		defer l.unrefMut.Unlock()
+		return len(l.unrefs)
+	}
+	for i := 0; i < 50 && queued() < 2; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := queued(); n != 2 {
+		t.Fatalf("Expected both dropped functions to be queued for release, got %d", n)
+	}
+
+	if _, err := l.Load(`x = 1`); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+	if n := queued(); n != 0 {
+		t.Errorf("Expected the references to be released at the next lock, %d left", n)
+	}
+}
+
+func TestLuaFunction(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	var stored *LuaFunction
+	if err := l.CreateLibrary("testlib", TableKeyValue{"register", func(cb *LuaFunction) { stored = cb }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	code := `
+function counter(start)
+	return function(n)
+		start = start + n
+		return start
+	end
+end
+testlib.register(function(s) return s .. "!" end)`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	ret, err := l.Call("counter", 10)
+	if err != nil {
+		t.Fatal("Error calling 'counter':", err)
+	}
+	inc, ok := ret[0].(*LuaFunction)
+	if !ok {
+		t.Fatalf("Expected a *LuaFunction, got %T", ret[0])
+	}
+	for _, c := range []struct {
+		n        int
+		expected LuaNumber
+	}{{1, 11}, {2, 13}} {
+		if ret, err := inc.Call(c.n); err != nil {
+			t.Fatal("Error calling returned function:", err)
+		} else if ret.First() != c.expected {
+			t.Errorf("Expected %v, got %v", c.expected, ret.First())
+		}
+	}
+
+	if stored == nil {
+		t.Fatal("Expected the callback to be passed to Go")
+	}
+	if ret, err := stored.Call("hi"); err != nil || ret.First() != LuaString("hi!") {
+		t.Error("Expected 'hi!' from the callback, got:", ret, err)
+	}
+
+	val, err := l.GetGlobal("counter")
+	if err != nil {
+		t.Fatal("Error getting a global function:", err)
+	}
+	if _, err := stored.Call(val); err == nil || !strings.Contains(err.Error(), "concatenate") {
+		t.Error("Expected the function to be passed back to Lua, got:", err)
+	}
+
+	inc.Release()
+	if _, err := inc.Call(1); err == nil {
+		t.Error("Expected an error calling a released function")
+	}
+}
+
+func TestCoroutine(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code := `
+function range(n)
+	local total = 0
+	for i = 1, n do
+		total = total + coroutine.yield(i)
+	end
+	return "total", total
+end
+function broken()
+	coroutine.yield(1)
+	error("broken")
+end`
+	if _, err := l.Load(code); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	co, err := l.NewCoroutine("range")
+	if err != nil {
+		t.Fatal("Error creating coroutine:", err)
+	}
+	ret, done, err := co.Resume(3)
+	for i := 1; i <= 3; i++ {
+		if err != nil || done || ret.First() != LuaNumber(i) {
+			t.Fatalf("Expected %d to be yielded, got %v (done: %v, err: %v)", i, ret, done, err)
+		}
+		ret, done, err = co.Resume(i * 10)
+	}
+	if err != nil || !done || len(ret) != 2 || ret[0] != LuaString("total") || ret[1] != LuaNumber(60) {
+		t.Errorf("Expected the coroutine to return 'total', 60, got %v (done: %v, err: %v)", ret, done, err)
+	}
+	if _, done, err := co.Resume(); err == nil || !done {
+		t.Error("Expected an error resuming a finished coroutine")
+	}
+
+	co, err = l.NewCoroutine("broken")
+	if err != nil {
+		t.Fatal("Error creating coroutine:", err)
+	}
+	if _, done, err := co.Resume(); err != nil || done {
+		t.Fatal("Expected the first resume to yield, got:", done, err)
+	}
+	if _, done, err := co.Resume(); err == nil || !strings.Contains(err.Error(), "broken") || !done {
+		t.Error("Expected the coroutine's error, got:", done, err)
+	}
+
+	if _, err := l.NewCoroutine("missing"); err == nil {
+		t.Error("Expected an error creating a coroutine for a missing function")
+	}
+}
+
+func TestRegisterAPI(t *testing.T) {
+	type API struct {
+		Add    func(a, b int) int
+		Greet  func(name string) string `luna:"greet"`
+		Count  func() int
+		Hidden func() `luna:"-"`
+		Limit  int
+	}
+
+	calls := 0
+	api := API{
+		Add:   func(a, b int) int { return a + b },
+		Greet: func(name string) string { return "hello " + name },
+		Count: func() int { calls++; return calls },
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	if err := l.RegisterAPI("api", &api); err != nil {
+		t.Fatal("Error registering API:", err)
+	}
+	ret, err := l.Load("return api.Add(1, 2), api.greet('luna'), api.Count(), api.Hidden, api.Limit")
+	if err != nil {
+		t.Fatal("Error calling API:", err)
+	}
+	if ret[0] != LuaNumber(3) || ret[1] != LuaString("hello luna") || ret[2] != LuaNumber(1) {
+		t.Error("Unexpected results:", ret)
+	}
+	for _, v := range ret[3:] {
+		if _, ok := v.(LuaNil); !ok {
+			t.Error("Expected skipped and non-function fields to be left out, got:", v)
+		}
+	}
+
+	if err := l.RegisterAPI("bad", 5); err == nil {
+		t.Error("Expected an error registering a non-struct")
+	}
+}
+
+func TestReturnTime(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	members := []TableKeyValue{
+		{"now", time.Now},
+		{"elapsed", func() time.Duration { return 2500 * time.Millisecond }},
+	}
+	if err := l.CreateLibrary("testlib", members...); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+
+	before := time.Now()
+	ret, err := l.Load("local now = testlib.now() return type(now), now, testlib.elapsed()")
+	if err != nil {
+		t.Fatal("Error calling functions returning times:", err)
+	}
+	if ret[0] != LuaString("number") {
+		t.Fatal("Expected time.Time to be returned as a number, got:", ret[0])
+	}
+	var sec float64
+	if err := ret[1].Unmarshal(&sec); err != nil || sec < float64(before.Unix()) || sec > float64(time.Now().Unix()+1) {
+		t.Error("Expected the current Unix time, got:", sec, err)
+	}
+	if ret[2] != LuaNumber(2.5e9) {
+		t.Error("Expected the duration in nanoseconds, got:", ret[2])
+	}
+}
+
+func TestBytecode(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	code, err := l.Dump("function twice(n) return n * 2 end return 'loaded'")
+	if err != nil {
+		t.Fatal("Error dumping bytecode:", err)
+	}
+
+	other := New(LibBase)
+	defer other.Close()
+	ret, err := other.LoadBytecode(code)
+	if err != nil {
+		t.Fatal("Error loading bytecode:", err)
+	}
+	if ret.First() != LuaString("loaded") {
+		t.Error("Expected the chunk to return 'loaded', got:", ret)
+	}
+	if ret, err := other.Call("twice", 4); err != nil || ret.First() != LuaNumber(8) {
+		t.Error("Expected the function defined by the bytecode to work, got:", ret, err)
+	}
+
+	wrongVersion := append([]byte(nil), code...)
+	wrongVersion[4] = 0x52
+	if _, err := other.LoadBytecode(wrongVersion); err == nil || !strings.Contains(err.Error(), "Lua 5.2") {
+		t.Error("Expected a version mismatch error, got:", err)
+	}
+	wrongPlatform := append([]byte(nil), code...)
+	wrongPlatform[10]++
+	if _, err := other.LoadBytecode(wrongPlatform); err == nil || !strings.Contains(err.Error(), "platform") {
+		t.Error("Expected a platform mismatch error, got:", err)
+	}
+	if _, err := other.LoadBytecode([]byte("return 1")); err == nil {
+		t.Error("Expected an error loading source as bytecode")
+	}
+}
+
+func TestValidateRegistrations(t *testing.T) {
+	type Point struct {
+		X, Y int
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	members := []TableKeyValue{
+		{"add", func(a, b int) int { return a + b }},
+		{"move", func(p *Point, dx int, rest ...LuaValue) (Point, error) { return *p, nil }},
+		{"log", func(msg string, args Varargs) {}},
+		{"count", func(m map[string]int) int { return len(m) }},
+		{"version", 1},
+	}
+	if err := l.CreateLibrary("good", members...); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	if err := l.ValidateRegistrations(); err != nil {
+		t.Error("Expected supported functions to validate, got:", err)
+	}
+
+	if err := l.CreateLibrary("bad", TableKeyValue{"channel", func() chan int { return nil }}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	if err := l.RegisterFuncWith("takeMap", func(map[string]chan int) {}, FuncOptions{}); err != nil {
+		t.Fatal("Error registering function:", err)
+	}
+	err := l.ValidateRegistrations()
+	if err == nil {
+		t.Fatal("Expected unsupported types to fail validation")
+	}
+	for _, msg := range []string{"bad.channel: unsupported result 1 of type chan int", "takeMap: unsupported parameter 1"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected %q in the error, got: %v", msg, err)
+		}
+	}
+}
+
+func TestUnmarshalGlobalIntegers(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	// Lua 5.1 numbers are doubles, so stay within the integers they hold exactly
+	ids := map[string]int64{
+		"max":  1<<53 - 1,
+		"big":  1<<53 - 12345,
+		"neg":  -(1<<53 - 7),
+		"zero": 0,
+	}
+	if err := l.SetGlobal("ids", ids); err != nil {
+		t.Fatal("Error setting global:", err)
+	}
+
+	var got map[string]int64
+	if err := l.UnmarshalGlobal("ids", &got); err != nil {
+		t.Fatal("Error unmarshalling global:", err)
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("Expected %v, got %v", ids, got)
+	}
+
+	var conf struct {
+		Owner uint64
+		Peers map[string]int64
+	}
+	if _, err := l.Load("config = {Owner = 9007199254740991, Peers = {a = -9007199254740991}}"); err != nil {
+		t.Fatal("Error loading config:", err)
+	}
+	if err := l.UnmarshalGlobal("config", &conf); err != nil {
+		t.Fatal("Error unmarshalling config:", err)
+	}
+	if conf.Owner != 1<<53-1 || conf.Peers["a"] != -(1<<53-1) {
+		t.Error("Unexpected config:", conf)
+	}
+
+	if err := l.UnmarshalGlobal("ids", got); err == nil {
+		t.Error("Expected an error for a non-pointer destination")
+	}
+}
+
+func TestStreamCoroutine(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	src := `
+function records(n)
+	for i = 1, n do
+		coroutine.yield(i, "record " .. i)
+	end
+end
+
+function failing()
+	coroutine.yield(1)
+	error("broken producer")
+end`
+	if _, err := l.Load(src); err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+
+	vals, errs := l.StreamCoroutine("records", 100)
+	n := 0
+	for ret := range vals {
+		n++
+		if len(ret) != 2 || ret[0] != LuaNumber(n) || ret[1] != LuaString(fmt.Sprint("record ", n)) {
+			t.Fatal("Unexpected record:", ret)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if n != 100 {
+		t.Error("Expected 100 records, got", n)
+	}
+
+	vals, errs = l.StreamCoroutine("failing")
+	n = 0
+	for range vals {
+		n++
+	}
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "broken producer") {
+		t.Error("Expected the producer's error, got:", err)
+	}
+	if n != 1 {
+		t.Error("Expected 1 record before the error, got", n)
+	}
+
+	_, errs = l.StreamCoroutine("missing")
+	if err := <-errs; err == nil {
+		t.Error("Expected an error streaming a missing function")
+	}
+}
+
+func TestCreateLibraryWithMeta(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	stored := map[string]int{}
+	meta := []TableKeyValue{
+		{"__index", func(_ LuaValue, key string) string { return "lazy " + key }},
+		{"__newindex", func(_ LuaValue, key string, val int) { stored[key] = val }},
+		{"__call", func(_ LuaValue, a, b int) int { return a * b }},
+	}
+	if err := l.CreateLibraryWithMeta("dyn", meta, TableKeyValue{"name", "dyn"}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	ret, err := l.Load("dyn.count = 3; return dyn.name, dyn.anything, dyn(6, 7)")
+	if err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+	if len(ret) != 3 || ret[0] != LuaString("dyn") || ret[1] != LuaString("lazy anything") || ret[2] != LuaNumber(42) {
+		t.Error("Unexpected results:", ret)
+	}
+	if stored["count"] != 3 {
+		t.Error("Expected __newindex to store count, got:", stored)
+	}
+
+	if err := l.CreateLibraryWithMeta("bad", []TableKeyValue{{"__index", make(chan int)}}); err == nil {
+		t.Error("Expected an error for an unsupported metamethod")
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	l := New(AllLibs)
+	defer l.Close()
+	src := `
+function grow(n)
+	local t = {}
+	for i = 1, n do
+		t[i] = string.rep("x", 1024) .. i
+	end
+	return #t
+end`
+	if _, err := l.Load(src); err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+
+	if err := l.SetMemoryLimit(l.MemoryUsage() + 512*1024); err != nil {
+		t.Fatal("Error setting memory limit:", err)
+	}
+	if ret, err := l.Call("grow", 10); err != nil || ret[0] != LuaNumber(10) {
+		t.Error("Expected a small allocation to succeed, got:", ret, err)
+	}
+
+	_, err := l.Call("grow", 10000)
+	var limitErr MemoryLimitExceeded
+	if !errors.As(err, &limitErr) {
+		t.Fatal("Expected MemoryLimitExceeded, got:", err)
+	}
+	if used := l.MemoryUsage(); used <= 0 || used > int(limitErr) {
+		t.Error("Expected usage within the limit, got:", used)
+	}
+
+	// the state is still usable once the garbage is collected
+	if _, err := l.Load("collectgarbage()"); err != nil {
+		t.Fatal("Error collecting garbage:", err)
+	}
+	if ret, err := l.Call("grow", 10); err != nil || ret[0] != LuaNumber(10) {
+		t.Error("Expected the state to recover, got:", ret, err)
+	}
+
+	if err := l.SetMemoryLimit(0); err != nil {
+		t.Fatal("Error removing memory limit:", err)
+	}
+	if _, err := l.Call("grow", 10000); err != nil {
+		t.Error("Expected no limit, got:", err)
+	}
+}
+
+func TestMemoryLimitCallArguments(t *testing.T) {
+	l := New(AllLibs)
+	defer l.Close()
+	src := `
+kept = {}
+function fill()
+	for i = 1, 1e9 do
+		kept[i] = string.rep("x", 1024) .. i
+	end
+end
+function size(s)
+	return #s
+end`
+	if _, err := l.Load(src); err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+	if err := l.SetMemoryLimit(l.MemoryUsage() + 512*1024); err != nil {
+		t.Fatal("Error setting memory limit:", err)
+	}
+
+	// kept holds on to everything, so the state stays at the limit
+	_, err := l.Call("fill")
+	var limitErr MemoryLimitExceeded
+	if !errors.As(err, &limitErr) {
+		t.Fatal("Expected MemoryLimitExceeded, got:", err)
+	}
+
+	// pushing the argument happens outside the script, so it must not abort
+	arg := strings.Repeat("y", 64*1024)
+	ret, err := l.Call("size", arg)
+	if err != nil && !errors.As(err, &limitErr) {
+		t.Fatal("Expected success or MemoryLimitExceeded, got:", err)
+	}
+	if err == nil && ret[0] != LuaNumber(len(arg)) {
+		t.Errorf("Expected %d, got %v", len(arg), ret[0])
+	}
+
+	if _, err := l.Load("kept = nil collectgarbage()"); err != nil {
+		t.Fatal("Error collecting garbage:", err)
+	}
+	if ret, err := l.Call("size", arg); err != nil || ret[0] != LuaNumber(len(arg)) {
+		t.Error("Expected the state to recover, got:", ret, err)
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	src := `
+count = 0
+function spin()
+	count = 0
+	while true do
+		count = count + 1
+	end
+end
+function small()
+	local n = 0
+	for i = 1, 100 do
+		n = n + i
+	end
+	return n
+end`
+	if _, err := l.Load(src); err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+	if err := l.SetInstructionLimit(5000); err != nil {
+		t.Fatal("Error setting instruction limit:", err)
+	}
+
+	var counts []LuaValue
+	for i := 0; i < 2; i++ {
+		_, err := l.Call("spin")
+		var limitErr InstructionLimit
+		if !errors.As(err, &limitErr) || limitErr != 5000 {
+			t.Fatal("Expected InstructionLimit, got:", err)
+		}
+		count, err := l.GetGlobal("count")
+		if err != nil {
+			t.Fatal("Error getting count:", err)
+		}
+		counts = append(counts, count)
+	}
+	if counts[0] != counts[1] || counts[0] == LuaNumber(0) {
+		t.Error("Expected the limit to stop the script at the same point, got:", counts)
+	}
+
+	// the count starts over for every call
+	for i := 0; i < 100; i++ {
+		if ret, err := l.Call("small"); err != nil || ret[0] != LuaNumber(5050) {
+			t.Fatal("Expected calls under the limit to succeed, got:", ret, err)
+		}
+	}
+
+	if err := l.SetInstructionLimit(0); err != nil {
+		t.Fatal("Error removing instruction limit:", err)
+	}
+	l.CallTimeout = 50 * time.Millisecond
+	if _, err := l.Call("spin"); errors.As(err, new(InstructionLimit)) {
+		t.Error("Expected no instruction limit, got:", err)
+	}
+}
+
+func TestCreateLibraryLuaTable(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	inner, err := l.BuildTable(func(b *TableBuilder) error {
+		return b.Set("shout", func(s string) string { return strings.ToUpper(s) })
+	})
+	if err != nil {
+		t.Fatal("Error building table:", err)
+	}
+	outer, err := l.BuildTable(func(b *TableBuilder) error {
+		if err := b.Set("inner", inner); err != nil {
+			return err
+		}
+		return b.Set("version", 2)
+	})
+	if err != nil {
+		t.Fatal("Error building table:", err)
+	}
+
+	if err := l.CreateLibrary("api", TableKeyValue{"util", outer}, TableKeyValue{"name", "api"}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	ret, err := l.Load("return api.util.inner.shout('hi'), api.util.version, api.name")
+	if err != nil {
+		t.Fatal("Error calling nested function:", err)
+	}
+	if len(ret) != 3 || ret[0] != LuaString("HI") || ret[1] != LuaNumber(2) || ret[2] != LuaString("api") {
+		t.Error("Unexpected results:", ret)
+	}
+
+	// and back again
+	val, err := l.GetGlobal("api")
+	if err != nil {
+		t.Fatal("Error getting library:", err)
+	}
+	util, ok := val.(LuaTable).Get("util").(LuaTable)
+	if !ok || util.Get("version") != LuaNumber(2) {
+		t.Fatal("Unexpected library:", val)
+	}
+	shout, ok := util.Get("inner").(LuaTable).Get("shout").(*LuaFunction)
+	if !ok {
+		t.Fatal("Expected a function, got:", util.Get("inner"))
+	}
+	if ret, err := shout.Call("round trip"); err != nil || len(ret) != 1 || ret[0] != LuaString("ROUND TRIP") {
+		t.Error("Unexpected results:", ret, err)
+	}
+}
+
+func TestAddModule(t *testing.T) {
+	l := New(LibBase | LibPackage)
+	defer l.Close()
+
+	loads := 0
+	err := l.AddModule("greeter", func(l *Luna) (LuaRet, error) {
+		loads++
+		mod, err := l.BuildTable(func(b *TableBuilder) error {
+			return b.Set("greet", func(name string) string { return "hello " + name })
+		})
+		return LuaRet{mod}, err
+	})
+	if err != nil {
+		t.Fatal("Error adding module:", err)
+	}
+	if err := l.AddModule("broken", func(*Luna) (LuaRet, error) {
+		return nil, errors.New("cannot load broken")
+	}); err != nil {
+		t.Fatal("Error adding module:", err)
+	}
+
+	ret, err := l.Load(`
+local g = require "greeter"
+local again = require "greeter"
+return g.greet("luna"), g == again`)
+	if err != nil {
+		t.Fatal("Error requiring module:", err)
+	}
+	if len(ret) != 2 || ret[0] != LuaString("hello luna") || ret[1] != LuaBool(true) {
+		t.Error("Unexpected results:", ret)
+	}
+	if loads != 1 {
+		t.Error("Expected the module to be loaded once, got", loads)
+	}
+
+	if _, err := l.Load(`require "broken"`); err == nil || !strings.Contains(err.Error(), "cannot load broken") {
+		t.Error("Expected the loader's error, got:", err)
+	}
+
+	noPackage := New(LibBase)
+	defer noPackage.Close()
+	if err := noPackage.AddModule("greeter", nil); err == nil {
+		t.Error("Expected an error without the package library")
+	}
+}
+
+func TestUnmarshalOptionalFields(t *testing.T) {
+	type Options struct {
+		Port    *int
+		Host    *string
+		Debug   *bool
+		Ratio   *float64
+		Timeout *int
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+	var fromArg Options
+	if err := l.RegisterFuncWith("configure", func(o Options) { fromArg = o }, FuncOptions{}); err != nil {
+		t.Fatal("Error registering function:", err)
+	}
+	src := `
+opts = {Port = 8080, Host = "localhost", Debug = false, Ratio = 0.5}
+configure(opts)
+return opts`
+	ret, err := l.Load(src)
+	if err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+
+	var fromTable Options
+	if err := ret[0].Unmarshal(&fromTable); err != nil {
+		t.Fatal("Error unmarshalling options:", err)
+	}
+	for name, o := range map[string]Options{"Unmarshal": fromTable, "argument": fromArg} {
+		if o.Port == nil || *o.Port != 8080 || o.Host == nil || *o.Host != "localhost" ||
+			o.Debug == nil || *o.Debug || o.Ratio == nil || *o.Ratio != 0.5 {
+			t.Errorf("%s: expected present fields to be set, got %+v", name, o)
+		}
+		if o.Timeout != nil {
+			t.Errorf("%s: expected the absent field to stay nil, got %d", name, *o.Timeout)
+		}
+	}
+
+	var n *int
+	if err := LuaNumber(3).Unmarshal(&n); err != nil || n == nil || *n != 3 {
+		t.Error("Expected a pointer to be allocated, got:", n, err)
+	}
+}
+
+func TestCheckFunctions(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	if _, err := l.Load("notAFunction = 5 function defined() return 1 end"); err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+
+	_, err := l.Call("undefined")
+	if err == nil || errors.Is(err, ErrFunctionNotFound) {
+		t.Error("Expected Lua's own error by default, got:", err)
+	}
+
+	l.CheckFunctions = true
+	for _, name := range []string{"undefined", "notAFunction"} {
+		_, err := l.Call(name)
+		if !errors.Is(err, ErrFunctionNotFound) || !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected ErrFunctionNotFound calling %s, got: %v", name, err)
+		}
+		if err := l.CallVoid(name); !errors.Is(err, ErrFunctionNotFound) {
+			t.Errorf("Expected ErrFunctionNotFound from CallVoid(%s), got: %v", name, err)
+		}
+	}
+	if ret, err := l.Call("defined"); err != nil || ret[0] != LuaNumber(1) {
+		t.Error("Expected defined functions to be called, got:", ret, err)
+	}
+}
+
+func TestLoadNamed(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	ret, err := l.LoadNamed("ok.lua", "return 1 + 1")
+	if err != nil || len(ret) != 1 || ret[0] != LuaNumber(2) {
+		t.Error("Unexpected results:", ret, err)
+	}
+
+	src := "local x = 1\n\nerror('runtime failure')"
+	if _, err := l.LoadNamed("myscript.lua", src); err == nil || !strings.HasPrefix(err.Error(), "myscript.lua:3: runtime failure") {
+		t.Error("Expected the chunk name and line in the error, got:", err)
+	}
+	if _, err := l.LoadNamed("syntax.lua", "\nreturn +"); err == nil || !strings.HasPrefix(err.Error(), "syntax.lua:2:") {
+		t.Error("Expected the chunk name in syntax errors, got:", err)
+	}
+
+	// functions defined by a named chunk keep its name
+	if _, err := l.LoadNamed("lib.lua", "function fail()\n\terror('from lib')\nend"); err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+	if _, err := l.Call("fail"); err == nil || !strings.Contains(err.Error(), "lib.lua:2: from lib") {
+		t.Error("Expected the chunk name in errors from its functions, got:", err)
+	}
+}
+
+func TestLunaError(t *testing.T) {
+	l := New(LibBase | LibDebug)
+	defer l.Close()
+	src := "function inner()\n\terror('deep failure')\nend\n\nfunction outer()\n\tinner()\nend"
+	if _, err := l.LoadNamed("errors.lua", src); err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+
+	_, err := l.Call("outer")
+	var lerr *LunaError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("Expected a *LunaError, got %T: %v", err, err)
+	}
+	if lerr.Source != "errors.lua" || lerr.Line != 2 || lerr.Message != "deep failure" {
+		t.Errorf("Unexpected error fields: %+v", lerr)
+	}
+	if err.Error() != "errors.lua:2: deep failure" {
+		t.Error("Expected the traceback to be left out of the message, got:", err)
+	}
+	if !strings.HasPrefix(lerr.Traceback, "stack traceback:") || !strings.Contains(lerr.Traceback, "outer") {
+		t.Error("Expected a traceback through outer, got:", lerr.Traceback)
+	}
+
+	// syntax errors, and errors without a position
+	_, err = l.LoadNamed("syntax.lua", "\n\nreturn +")
+	if !errors.As(err, &lerr) || lerr.Source != "syntax.lua" || lerr.Line != 3 {
+		t.Errorf("Unexpected syntax error: %#v", err)
+	}
+	_, err = l.Load("error('no position', 0)")
+	if !errors.As(err, &lerr) || lerr.Source != "" || lerr.Line != 0 || lerr.Message != "no position" {
+		t.Errorf("Unexpected error: %#v", err)
+	}
+
+	// without the debug library there's no traceback, but the rest still works
+	noDebug := New(LibBase)
+	defer noDebug.Close()
+	_, err = noDebug.Load("local x = nil\nreturn x.field")
+	if !errors.As(err, &lerr) || lerr.Line != 2 || lerr.Traceback != "" || !strings.Contains(lerr.Message, "attempt to index") {
+		t.Errorf("Unexpected error: %#v", err)
+	}
+}
+
+func TestSetConstants(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	type Status int
+	consts := map[string]interface{}{
+		"OK":       Status(200),
+		"NotFound": Status(404),
+		"Teapot":   Status(418),
+	}
+	if err := l.SetConstants("Status", consts, ConstantOptions{Reverse: "names"}); err != nil {
+		t.Fatal("Error setting constants:", err)
+	}
+	ret, err := l.Load("return Status.OK, Status.Teapot, Status.names[404], Status.names[Status.OK], Status.names[500]")
+	if err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+	if len(ret) != 5 || ret[0] != LuaNumber(200) || ret[1] != LuaNumber(418) ||
+		ret[2] != LuaString("NotFound") || ret[3] != LuaString("OK") {
+		t.Error("Unexpected results:", ret)
+	}
+	if _, ok := ret[4].(LuaNil); !ok {
+		t.Error("Expected unknown values to have no name, got:", ret[4])
+	}
+
+	for _, code := range []string{"Status.OK = 1", "Status.New = 1", "Status.names[200] = 'x'", "setmetatable(Status, nil)"} {
+		if _, err := l.Load(code); err == nil {
+			t.Errorf("Expected %q to fail", code)
+		}
+	}
+	if ret, err := l.Load("return Status.OK"); err != nil || ret[0] != LuaNumber(200) {
+		t.Error("Expected constants to be unchanged, got:", ret, err)
+	}
+
+	if err := l.SetConstants("Flags", map[string]interface{}{"A": 1, "B": 1}, ConstantOptions{Reverse: "names"}); err == nil {
+		t.Error("Expected an error for duplicate values with a reverse table")
+	}
+	if err := l.SetConstants("Flags", map[string]interface{}{"A": 1, "B": 1}, ConstantOptions{}); err != nil {
+		t.Error("Expected duplicate values without a reverse table to be allowed, got:", err)
+	}
+	if err := l.SetConstants("Bad", map[string]interface{}{"names": 1}, ConstantOptions{Reverse: "names"}); err == nil {
+		t.Error("Expected an error for a constant named like the reverse table")
+	}
+}
+
+func TestCallTraceback(t *testing.T) {
+	l := New(LibBase | LibDebug)
+	defer l.Close()
+	src := "function leaf(t)\n\treturn t.field\nend\n\nfunction branch()\n\treturn leaf(nil)\nend"
+	if _, err := l.LoadNamed("tree.lua", src); err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+
+	check := func(how string, err error) {
+		var lerr *LunaError
+		if !errors.As(err, &lerr) {
+			t.Errorf("%s: expected a *LunaError, got %T: %v", how, err, err)
+			return
+		}
+		if lerr.Line != 2 || !strings.Contains(lerr.Message, "attempt to index") {
+			t.Errorf("%s: unexpected error: %+v", how, lerr)
+		}
+		for _, fn := range []string{"leaf", "branch"} {
+			if !strings.Contains(lerr.Traceback, fn) {
+				t.Errorf("%s: expected %s in the traceback, got: %s", how, fn, lerr.Traceback)
+			}
+		}
+	}
+
+	_, err := l.Call("branch")
+	check("Call", err)
+	_, err = l.CallContext(context.Background(), "branch")
+	check("CallContext", err)
+	check("CallVoid", l.CallVoid("branch"))
+	l.CallTimeout = time.Second
+	_, err = l.Call("branch")
+	check("Call with a timeout", err)
+
+	// a handler set with SetMessageHandler replaces debug.traceback
+	if err := l.SetMessageHandler(func(msg string) string { return "handled" }); err != nil {
+		t.Fatal("Error setting message handler:", err)
+	}
+	_, err = l.Call("branch")
+	var lerr *LunaError
+	if !errors.As(err, &lerr) || lerr.Message != "handled" || lerr.Traceback != "" {
+		t.Errorf("Expected the message handler's error, got: %#v", err)
+	}
+	if err := l.SetMessageHandler(nil); err != nil {
+		t.Fatal("Error removing message handler:", err)
+	}
+	_, err = l.Call("branch")
+	check("Call after removing the handler", err)
+}
+
+func TestMaxSourceLen(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+	l.MaxSourceLen = 64
+
+	if ret, err := l.Load("return 1"); err != nil || ret[0] != LuaNumber(1) {
+		t.Error("Expected short source to load, got:", ret, err)
+	}
+
+	long := "x = 1" + strings.Repeat(" ", 100)
+	var tooLong SourceTooLong
+	if _, err := l.Load(long); !errors.As(err, &tooLong) || int(tooLong) != 64 {
+		t.Error("Expected SourceTooLong from Load, got:", err)
+	}
+	if err := l.Preload(long); !errors.As(err, &tooLong) {
+		t.Error("Expected SourceTooLong from Preload, got:", err)
+	}
+	if _, err := l.Compile("long", long); !errors.As(err, &tooLong) {
+		t.Error("Expected SourceTooLong from Compile, got:", err)
+	}
+	if val, err := l.GetGlobal("x"); err != nil {
+		t.Fatal("Error getting global:", err)
+	} else if _, ok := val.(LuaNil); !ok {
+		t.Error("Expected rejected source not to run, got:", val)
+	}
+
+	// LoadReader stops reading once the source is too long
+	r := &countingReader{r: strings.NewReader(strings.Repeat("-", 1<<20))}
+	if _, err := l.LoadReader(r); !errors.As(err, &tooLong) {
+		t.Error("Expected SourceTooLong from LoadReader, got:", err)
+	}
+	if r.n > 1024 {
+		t.Error("Expected LoadReader to stop reading early, read", r.n)
+	}
+	if ret, err := l.LoadReader(strings.NewReader("return 2")); err != nil || ret[0] != LuaNumber(2) {
+		t.Error("Expected LoadReader to load short source, got:", ret, err)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestSpreadResults(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	split := func(s string) []string { return strings.Split(s, ",") }
+	if err := l.RegisterFuncWith("split", split, FuncOptions{Spread: true}); err != nil {
+		t.Fatal("Error registering function:", err)
+	}
+	if err := l.RegisterFuncWith("splitTable", split, FuncOptions{}); err != nil {
+		t.Fatal("Error registering function:", err)
+	}
+	parse := func(s string) (string, []int, error) {
+		if s == "" {
+			return "", nil, errors.New("empty input")
+		}
+		return s, []int{len(s), len(s) * 2}, nil
+	}
+	if err := l.RegisterFuncWith("parse", parse, FuncOptions{Returns: TranslateErrors, Spread: true}); err != nil {
+		t.Fatal("Error registering function:", err)
+	}
+
+	ret, err := l.Load(`
+local a, b, c = split("x,y,z")
+local t = splitTable("x,y")
+return a, b, c, select('#', split("one")), type(t), #t, select('#', split(""))`)
+	if err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+	expected := LuaRet{LuaString("x"), LuaString("y"), LuaString("z"), LuaNumber(1), LuaString("table"), LuaNumber(2), LuaNumber(1)}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected %v, got %v", expected, ret)
+	}
+
+	ret, err = l.Load("return parse('abc')")
+	if err != nil {
+		t.Fatal("Error calling parse:", err)
+	}
+	if len(ret) != 3 || ret[0] != LuaString("abc") || ret[1] != LuaNumber(3) || ret[2] != LuaNumber(6) {
+		t.Error("Unexpected results:", ret)
+	}
+	if _, err := l.Load("return parse('')"); err == nil || !strings.Contains(err.Error(), "empty input") {
+		t.Error("Expected parse's error, got:", err)
+	}
+}
+
+func TestReentrantGoFunction(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	// depth calls back into Lua, which calls depth again with other
+	// arguments, before using its own
+	depth := func(n int, label string) string {
+		if n > 0 {
+			if _, err := l.Call("descend", n-1); err != nil {
+				return "error: " + err.Error()
+			}
+		}
+		return fmt.Sprintf("%s %d", label, n)
+	}
+	if err := l.RegisterFuncWith("depth", depth, FuncOptions{}); err != nil {
+		t.Fatal("Error registering function:", err)
+	}
+	if _, err := l.Load("function descend(n) return depth(n, 'inner') end"); err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+
+	ret, err := l.Load("return depth(3, 'outer')")
+	if err != nil {
+		t.Fatal("Error calling depth:", err)
+	}
+	if len(ret) != 1 || ret[0] != LuaString("outer 3") {
+		t.Error("Expected the outer call's arguments to survive the inner calls, got:", ret)
+	}
+
+	// calls from many goroutines are serialized, each with its own arguments
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			label := fmt.Sprint("g", i)
+			ret, err := l.Call("depth", i%4, label)
+			if err != nil {
+				errs <- err
+			} else if want := fmt.Sprintf("%s %d", label, i%4); len(ret) != 1 || ret[0] != LuaString(want) {
+				errs <- fmt.Errorf("expected %q, got %v", want, ret)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestGoFunctionArgumentErrors(t *testing.T) {
+	l := New(LibBase)
+	defer l.Close()
+
+	add := func(a, b int) int { return a + b }
+	sum := func(first int, rest ...int) int {
+		for _, n := range rest {
+			first += n
+		}
+		return first
+	}
+	if err := l.RegisterFuncWith("add", add, FuncOptions{}); err != nil {
+		t.Fatal("Error registering function:", err)
+	}
+	if err := l.CreateLibrary("mathx", TableKeyValue{"sum", sum}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+
+	tests := []struct {
+		code string
+		msg  string
+	}{
+		{"add(1)", "Not enough arguments to 'add': expected 2, got 1"},
+		{"add(1, 'two')", "bad argument #2 to 'add'"},
+		{"mathx.sum()", "Not enough arguments to 'mathx.sum': expected 1, got 0"},
+		{"mathx.sum(1, 2, {})", "bad argument #3 to 'mathx.sum'"},
+	}
+	for _, test := range tests {
+		_, err := l.Load(test.code)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%s: expected an error containing %q, got: %v", test.code, test.msg, err)
+		}
+	}
+
+	// the errors can be caught, and the state is still usable afterwards
+	ret, err := l.Load("local ok, err = pcall(add, 1) return ok, mathx.sum(1), mathx.sum(1, 2, 3), add(2, 3)")
+	if err != nil {
+		t.Fatal("Error loading test lua code:", err)
+	}
+	if len(ret) != 4 || ret[0] != LuaBool(false) || ret[1] != LuaNumber(1) || ret[2] != LuaNumber(6) || ret[3] != LuaNumber(5) {
+		t.Error("Unexpected results:", ret)
+	}
+
+	// functions without a registered name are named after the Go function
+	if err := l.SetGlobal("anon", add); err != nil {
+		t.Fatal("Error setting global:", err)
+	}
+	if _, err := l.Load("anon()"); err == nil || !strings.Contains(err.Error(), "TestGoFunctionArgumentErrors") {
+		t.Error("Expected the Go function's name in the error, got:", err)
+	}
+}
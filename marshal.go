@@ -3,15 +3,167 @@ package luna
 import (
 	"encoding"
 	"fmt"
+	"math"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type LuaValue interface {
 	Unmarshal(interface{}) error
 }
 
-func convertBasic(src LuaValue, dst interface{}) error {
+var luaValueType = reflect.TypeOf((*LuaValue)(nil)).Elem()
+
+// LuaUnmarshaler is implemented by types that convert Lua values to
+// themselves, like json.Unmarshaler.
+type LuaUnmarshaler interface {
+	UnmarshalLua(LuaValue) error
+}
+
+// luaUnmarshaler returns dst as a LuaUnmarshaler, if it implements it with
+// either a value or pointer receiver. dst is a pointer or a reflect.Value.
+func luaUnmarshaler(dst interface{}) LuaUnmarshaler {
+	v, ok := dst.(reflect.Value)
+	if !ok {
+		v = reflect.ValueOf(dst)
+	} else if v.CanAddr() {
+		v = v.Addr()
+	}
+	if !v.IsValid() || !v.CanInterface() || v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil
+	}
+	u, _ := v.Interface().(LuaUnmarshaler)
+	return u
+}
+
+// Rounding controls how a Lua number with a fractional part is assigned to a
+// Go integer.
+type Rounding int
+
+const (
+	// Truncate discards the fractional part, rounding toward zero
+	Truncate Rounding = iota
+	// RoundNearest rounds to the nearest integer, with halves away from zero
+	RoundNearest
+	// RejectFractions fails instead of assigning the number
+	RejectFractions
+)
+
+// toInteger applies r to f, returning false if f can't be assigned to an
+// integer.
+func (r Rounding) toInteger(f float64) (float64, bool) {
+	switch r {
+	case RoundNearest:
+		return math.Round(f), true
+	case RejectFractions:
+		return f, f == math.Trunc(f)
+	}
+	return math.Trunc(f), true
+}
+
+// UnmarshalOptions control how Lua values are converted to Go values.
+// The zero value is the strict behavior used by Unmarshal.
+type UnmarshalOptions struct {
+	// Coerce converts between strings and numbers like Lua itself does, so
+	// the Lua string "5" can be unmarshalled into an int and the Lua number 5
+	// into a string.
+	Coerce bool
+
+	// UseSetters makes keys that don't match an exported struct field call a
+	// method Set<Key> with the converted value instead, if there is one.
+	UseSetters bool
+
+	// Rounding controls how fractional numbers are assigned to integers.
+	Rounding Rounding
+
+	// DurationEncoding is the unit of numbers unmarshalled into a
+	// time.Duration. It should match the DurationEncoding of the Luna the
+	// value came from; the default is nanoseconds.
+	DurationEncoding DurationEncoding
+
+	// cachedFields looks up struct fields in a per-type index instead of by
+	// name each time
+	cachedFields bool
+}
+
+// Unmarshal converts lv into d, which must be a pointer, according to opts.
+func (opts UnmarshalOptions) Unmarshal(lv LuaValue, d interface{}) error {
+	return unmarshalWith(lv, d, opts)
+}
+
+func unmarshalWith(lv LuaValue, d interface{}, opts UnmarshalOptions) error {
+	switch v := lv.(type) {
+	case LuaTable:
+		return v.unmarshal(d, opts)
+	case LuaNumber, LuaBool, LuaString:
+		return convertBasic(v, d, opts)
+	}
+	return lv.Unmarshal(d)
+}
+
+// luaDecimal and luaHex match the strings Lua converts to numbers: decimal
+// numbers with an optional fraction and exponent, and hexadecimal integers.
+var (
+	luaDecimal = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+	luaHex     = regexp.MustCompile(`^[+-]?0[xX][0-9a-fA-F]+$`)
+)
+
+// coerce converts between Lua strings and numbers to suit a destination of
+// kind k, following Lua's coercion rules. src is returned as-is if it can't be
+// coerced.
+func coerce(src LuaValue, k reflect.Kind) LuaValue {
+	switch v := src.(type) {
+	case LuaString:
+		if k < reflect.Int || k > reflect.Float64 {
+			return src
+		}
+		str := strings.TrimSpace(string(v))
+		if luaDecimal.MatchString(str) {
+			if f, err := strconv.ParseFloat(str, 64); err == nil {
+				return LuaNumber(f)
+			}
+		} else if luaHex.MatchString(str) {
+			neg := str[0] == '-'
+			str = strings.TrimLeft(str, "+-")
+			if u, err := strconv.ParseUint(str[2:], 16, 64); err == nil {
+				if neg {
+					return LuaNumber(-float64(u))
+				}
+				return LuaNumber(float64(u))
+			}
+		}
+	case LuaNumber:
+		if k == reflect.String {
+			return LuaString(v.String())
+		}
+	}
+	return src
+}
+
+// indirect follows the pointer v to the value it points to, allocating any nil
+// pointers on the way, like optional *int struct fields. A v that isn't a
+// pointer is returned as-is.
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			if !v.CanSet() {
+				break
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func convertBasic(src LuaValue, dst interface{}, opts UnmarshalOptions) error {
+	if u := luaUnmarshaler(dst); u != nil {
+		return u.UnmarshalLua(src)
+	}
+
 	var destVal reflect.Value
 	var ok bool
 	if destVal, ok = dst.(reflect.Value); !ok {
@@ -21,21 +173,50 @@ func convertBasic(src LuaValue, dst interface{}) error {
 		}
 	}
 
+	destVal = indirect(destVal)
+
+	// times and durations are decoded like function arguments
+	if destVal.Type() == timeType || destVal.Type() == durationType {
+		switch src.(type) {
+		case LuaNumber, LuaString:
+			return setTimeValue(destVal, src, opts.DurationEncoding)
+		}
+	}
+
 	if v, ok := src.(LuaString); ok {
-		dst := destVal.Interface()
-		if unmarshaler, ok := dst.(encoding.TextUnmarshaler); ok {
-			return unmarshaler.UnmarshalText([]byte(v))
+		if destVal.CanAddr() {
+			if unmarshaler, ok := destVal.Addr().Interface().(encoding.TextUnmarshaler); ok {
+				return unmarshaler.UnmarshalText([]byte(v))
+			}
 		}
-		dst = reflect.Indirect(destVal).Interface()
-		if unmarshaler, ok := dst.(encoding.TextUnmarshaler); ok {
+		if unmarshaler, ok := destVal.Interface().(encoding.TextUnmarshaler); ok {
 			return unmarshaler.UnmarshalText([]byte(v))
 		}
 	}
 
-	destVal = reflect.Indirect(destVal)
-
 	destType := destVal.Type()
 
+	if isEmptyInterface(destType) {
+		setInterface(destVal, goValue(src))
+		return nil
+	}
+
+	if opts.Coerce {
+		src = coerce(src, destType.Kind())
+	}
+
+	if _, ok := src.(LuaBool); ok && destType.Kind() != reflect.Bool {
+		return fmt.Errorf("Cannot assign Lua boolean to Go %s", destType)
+	}
+
+	if n, ok := src.(LuaNumber); ok && destType.Kind() >= reflect.Int && destType.Kind() <= reflect.Uint64 {
+		f, ok := opts.Rounding.toInteger(float64(n))
+		if !ok {
+			return fmt.Errorf("Cannot assign fractional Lua number %v to Go %s", n, destType)
+		}
+		src = LuaNumber(f)
+	}
+
 	srcVal := reflect.ValueOf(src)
 	if !srcVal.Type().ConvertibleTo(destType) {
 		return fmt.Errorf("Cannot assign '%s' to '%s': given = %v", srcVal.Type(), destType, src)
@@ -47,19 +228,48 @@ func convertBasic(src LuaValue, dst interface{}) error {
 type LuaNumber float64
 
 func (lv LuaNumber) Unmarshal(d interface{}) error {
-	return convertBasic(lv, d)
+	return convertBasic(lv, d, UnmarshalOptions{})
+}
+
+// IsInteger reports whether lv has no fractional part. Lua 5.1 doesn't
+// distinguish integers from floats, so this is the best that can be done.
+func (lv LuaNumber) IsInteger() bool {
+	f := float64(lv)
+	return !math.IsInf(f, 0) && f == math.Trunc(f)
+}
+
+// String formats lv like Lua's tostring().
+func (lv LuaNumber) String() string {
+	f := float64(lv)
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', 14, 64)
 }
 
 type LuaBool bool
 
 func (lv LuaBool) Unmarshal(d interface{}) error {
-	return convertBasic(lv, d)
+	return convertBasic(lv, d, UnmarshalOptions{})
+}
+
+func (lv LuaBool) String() string {
+	return strconv.FormatBool(bool(lv))
 }
 
 type LuaString string
 
 func (lv LuaString) Unmarshal(d interface{}) error {
-	return convertBasic(lv, d)
+	return convertBasic(lv, d, UnmarshalOptions{})
+}
+
+func (lv LuaString) String() string {
+	return string(lv)
 }
 
 // the type here isn't significant, as long as it's nil-able
@@ -81,10 +291,20 @@ func (lv LuaNil) Unmarshal(d interface{}) error {
 	return nil
 }
 
+func (lv LuaNil) String() string {
+	return "nil"
+}
+
 type LuaTable struct {
 	indexed map[float64]LuaValue
 	mapped  map[string]LuaValue
 	booled  map[bool]LuaValue
+
+	// result of the __len metamethod, if the table had one
+	metaLen *int
+
+	// keys in the order they were visited
+	keys []LuaValue
 }
 
 func (lv LuaTable) GetIndex(i float64) LuaValue {
@@ -93,9 +313,16 @@ func (lv LuaTable) GetIndex(i float64) LuaValue {
 func (lv LuaTable) Get(i string) LuaValue {
 	return lv.mapped[i]
 }
+
+// Map returns the entries with string keys. The map is shared with lv, so
+// changing it changes lv and every copy of it; use Clone first if that's not
+// wanted.
 func (lv LuaTable) Map() map[string]LuaValue {
 	return lv.mapped
 }
+
+// Slice returns the array elements starting at index 1. The slice is new, but
+// tables in it are shared with lv.
 func (lv LuaTable) Slice() (ret []LuaValue) {
 	for i := 1; i <= len(lv.indexed); i++ {
 		if v, ok := lv.indexed[float64(i)]; ok {
@@ -107,23 +334,191 @@ func (lv LuaTable) Slice() (ret []LuaValue) {
 	return
 }
 
-func convertTableVal(src LuaValue, d interface{}) error {
-	if _, ok := src.(LuaTable); ok {
-		return src.Unmarshal(d)
+// Keys returns the keys of the entries in the order they were visited when
+// the table was returned to Go, which is the order pairs() gives in Lua. Note
+// that Lua doesn't keep the order a table's keys were added in. The keys are
+// LuaNumber, LuaString or LuaBool values, and the slice is new. Entries added
+// through Map afterwards aren't included.
+func (lv LuaTable) Keys() []LuaValue {
+	keys := make([]LuaValue, 0, len(lv.keys))
+	for _, k := range lv.keys {
+		var ok bool
+		switch k := k.(type) {
+		case LuaNumber:
+			_, ok = lv.indexed[float64(k)]
+		case LuaString:
+			_, ok = lv.mapped[string(k)]
+		case LuaBool:
+			_, ok = lv.booled[bool(k)]
+		}
+		if ok {
+			keys = append(keys, k)
+		}
 	}
-	return convertBasic(src, d)
+	return keys
 }
 
-func setMap(destVal reflect.Value, k interface{}, v LuaValue, destType reflect.Type) error {
+// Clone returns a deep copy of lv, which shares nothing with it.
+func (lv LuaTable) Clone() LuaTable {
+	c := LuaTable{
+		indexed: make(map[float64]LuaValue, len(lv.indexed)),
+		mapped:  make(map[string]LuaValue, len(lv.mapped)),
+		booled:  make(map[bool]LuaValue, len(lv.booled)),
+	}
+	for k, v := range lv.indexed {
+		c.indexed[k] = cloneValue(v)
+	}
+	for k, v := range lv.mapped {
+		c.mapped[k] = cloneValue(v)
+	}
+	for k, v := range lv.booled {
+		c.booled[k] = cloneValue(v)
+	}
+	if lv.metaLen != nil {
+		n := *lv.metaLen
+		c.metaLen = &n
+	}
+	c.keys = lv.Keys()
+	return c
+}
+
+func cloneValue(v LuaValue) LuaValue {
+	if t, ok := v.(LuaTable); ok {
+		return t.Clone()
+	}
+	return v
+}
+
+// RawLen returns the number of contiguous array elements starting at index 1,
+// ignoring any __len metamethod.
+func (lv LuaTable) RawLen() int {
+	n := 0
+	for {
+		if _, ok := lv.indexed[float64(n+1)]; !ok {
+			return n
+		}
+		n++
+	}
+}
+
+// Len returns the result of the table's __len metamethod at the time it was
+// returned to Go, or RawLen if it didn't have one.
+func (lv LuaTable) Len() int {
+	if lv.metaLen != nil {
+		return *lv.metaLen
+	}
+	return lv.RawLen()
+}
+
+// Count returns the total number of entries, including those that aren't part
+// of the array.
+func (lv LuaTable) Count() int {
+	return len(lv.indexed) + len(lv.mapped) + len(lv.booled)
+}
+
+// String formats lv like a Lua table constructor on one line, e.g.
+// {1, 2, key="value"}. See Encode for the order of the entries.
+func (lv LuaTable) String() string {
+	var b strings.Builder
+	e := &encoder{w: &b}
+	e.table(lv, 0)
+	return b.String()
+}
+
+// isEmptyInterface reports whether typ is interface{}, which Lua values are
+// decoded into as plain Go values by goValue.
+func isEmptyInterface(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Interface && typ.NumMethod() == 0
+}
+
+// goValue converts lv to a plain Go value for schemaless decoding, like
+// encoding/json does for interface{}: numbers become float64, strings string,
+// booleans bool and nil nil. Tables become []interface{} if they're
+// non-empty arrays, otherwise map[string]interface{}, with other keys
+// formatted like tostring(). Pointers and errors become the Go values they
+// hold.
+func goValue(lv LuaValue) interface{} {
+	switch v := lv.(type) {
+	case nil, LuaNil:
+		return nil
+	case LuaNumber:
+		return float64(v)
+	case LuaString:
+		return string(v)
+	case LuaBool:
+		return bool(v)
+	case LuaTable:
+		return v.goValue()
+	case LuaPointer:
+		return v.Ptr
+	case LuaError:
+		return v.Err
+	}
+	return lv
+}
+
+// setInterface sets the interface{} value v to x, which may be nil.
+func setInterface(v reflect.Value, x interface{}) {
+	if x == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+	v.Set(reflect.ValueOf(x))
+}
+
+func (lv LuaTable) goValue() interface{} {
+	if n := lv.RawLen(); n > 0 && n == len(lv.indexed) && len(lv.mapped) == 0 && len(lv.booled) == 0 {
+		slice := make([]interface{}, n)
+		for i := range slice {
+			slice[i] = goValue(lv.indexed[float64(i+1)])
+		}
+		return slice
+	}
+	m := make(map[string]interface{}, len(lv.indexed)+len(lv.mapped)+len(lv.booled))
+	for k, v := range lv.indexed {
+		m[LuaNumber(k).String()] = goValue(v)
+	}
+	for k, v := range lv.booled {
+		m[LuaBool(k).String()] = goValue(v)
+	}
+	for k, v := range lv.mapped {
+		m[k] = goValue(v)
+	}
+	return m
+}
+
+func convertTableVal(src LuaValue, d interface{}, opts UnmarshalOptions) error {
+	if t, ok := src.(LuaTable); ok {
+		return t.unmarshal(d, opts)
+	}
+	return convertBasic(src, d, opts)
+}
+
+func setMap(destVal reflect.Value, k interface{}, v LuaValue, destType reflect.Type, opts UnmarshalOptions) error {
 	dest := reflect.New(destType.Elem())
-	if err := convertTableVal(v, dest.Interface()); err != nil {
+	if err := convertTableVal(v, dest.Interface(), opts); err != nil {
 		return err
 	}
 	destVal.SetMapIndex(reflect.ValueOf(k), dest.Elem())
 	return nil
 }
 
-func (lv LuaTable) Unmarshal(d interface{}) (err error) {
+func (lv LuaTable) Unmarshal(d interface{}) error {
+	return lv.unmarshal(d, UnmarshalOptions{})
+}
+
+// UnmarshalInto is like Unmarshal, but looks up struct fields in an index
+// built once per type instead of resolving each key by name. It gives the same
+// results, but is faster when decoding the same struct types repeatedly.
+func (lv LuaTable) UnmarshalInto(d interface{}) error {
+	return lv.unmarshal(d, UnmarshalOptions{cachedFields: true})
+}
+
+func (lv LuaTable) unmarshal(d interface{}, opts UnmarshalOptions) (err error) {
+	if u := luaUnmarshaler(d); u != nil {
+		return u.UnmarshalLua(lv)
+	}
+
 	var destVal reflect.Value
 	var ok bool
 	if destVal, ok = d.(reflect.Value); !ok {
@@ -132,9 +527,13 @@ func (lv LuaTable) Unmarshal(d interface{}) (err error) {
 			return fmt.Errorf("Must pass a pointer type to Unmarshal")
 		}
 	}
-	destVal = reflect.Indirect(destVal)
+	destVal = indirect(destVal)
 
 	destType := destVal.Type()
+	if isEmptyInterface(destType) {
+		setInterface(destVal, lv.goValue())
+		return nil
+	}
 	switch k := destType.Kind(); k {
 	case reflect.Slice, reflect.Array:
 		items := lv.Slice()
@@ -151,22 +550,35 @@ func (lv LuaTable) Unmarshal(d interface{}) (err error) {
 
 		for i, v := range items {
 			dest := reflect.New(destType.Elem())
-			if er := convertTableVal(v, dest.Interface()); er != nil {
+			if er := convertTableVal(v, dest.Interface(), opts); er != nil {
 				err = er
 			} else {
 				destVal.Index(i).Set(dest.Elem())
 			}
 		}
 	case reflect.Struct:
-		// TODO: find a better way to check for a non-existant field
-		zero := reflect.Value{}
+		lookup := fieldByName
+		if opts.cachedFields {
+			lookup = cachedFieldByName
+		}
 		for k, v := range lv.mapped {
-			field := destVal.FieldByName(strings.Title(k))
-			if field == zero {
+			field := lookup(destVal, k)
+			if !field.IsValid() {
+				field = lookup(destVal, strings.Title(k))
+			}
+			if !field.IsValid() {
+				if m := setter(destVal, k); opts.UseSetters && m.IsValid() {
+					arg := reflect.New(m.Type().In(0))
+					if er := convertTableVal(v, arg.Interface(), opts); er != nil {
+						err = er
+					} else if er := callSetter(m, arg.Elem()); er != nil {
+						err = er
+					}
+				}
 				continue
 			}
 
-			if er := convertTableVal(v, field); err != nil {
+			if er := convertTableVal(v, field, opts); er != nil {
 				err = er
 			}
 		}
@@ -178,15 +590,15 @@ func (lv LuaTable) Unmarshal(d interface{}) (err error) {
 		keyType := destType.Key()
 		if keyType.Kind() >= reflect.Int && keyType.Kind() <= reflect.Complex128 {
 			for k, v := range lv.indexed {
-				setMap(destVal, k, v, destType)
+				setMap(destVal, k, v, destType, opts)
 			}
 		} else if keyType.Kind() == reflect.String {
 			for k, v := range lv.mapped {
-				setMap(destVal, k, v, destType)
+				setMap(destVal, k, v, destType, opts)
 			}
 		} else if keyType.Kind() == reflect.Bool {
 			for k, v := range lv.booled {
-				setMap(destVal, k, v, destType)
+				setMap(destVal, k, v, destType, opts)
 			}
 		} else if keyType.Kind() == reflect.Struct {
 			return fmt.Errorf("Struct key types not currently supported")
@@ -194,6 +606,115 @@ func (lv LuaTable) Unmarshal(d interface{}) (err error) {
 			return fmt.Errorf("Invalid key type: %s", keyType)
 		}
 	}
+	return err
+}
+
+// luaName returns the key of field f in Lua tables, which is set with a tag
+// like `luna:"name"`, or is otherwise the field's name. ok is false if the
+// field is skipped with `luna:"-"`. It's used both when pushing structs and
+// when setting their fields, so the two stay symmetric.
+func luaName(f reflect.StructField) (name string, ok bool) {
+	switch tag := f.Tag.Get("luna"); tag {
+	case "-":
+		return "", false
+	case "":
+		return f.Name, true
+	default:
+		return tag, true
+	}
+}
+
+// fieldByName is like reflect.Value.FieldByName, but finds fields by their Lua
+// name (see luaName) and allocates any nil embedded struct pointers on the way
+// to a promoted field instead of panicking.
+// The zero Value is returned if there's no such exported field.
+func fieldByName(v reflect.Value, name string) reflect.Value {
+	typ := v.Type()
+	if f, ok := typ.FieldByName(name); ok && f.IsExported() && f.Tag.Get("luna") == "" {
+		return fieldByIndex(v, f.Index)
+	}
+	// the name may come from a tag instead
+	for _, f := range reflect.VisibleFields(typ) {
+		if n, ok := luaName(f); ok && n == name && f.IsExported() && promoted(typ, f) {
+			return fieldByIndex(v, f.Index)
+		}
+	}
+	return reflect.Value{}
+}
+
+// promoted reports whether f, one of the VisibleFields of typ, can be accessed
+// by name, i.e. it isn't hidden by another field or ambiguous.
+func promoted(typ reflect.Type, f reflect.StructField) bool {
+	sf, ok := typ.FieldByName(f.Name)
+	return ok && reflect.DeepEqual(sf.Index, f.Index)
+}
+
+// fieldCache maps struct types to the index of each field name, as used by
+// cachedFieldByName.
+var fieldCache sync.Map
+
+// cachedFieldByName is like fieldByName, but uses an index of the field names
+// of v's type, built the first time the type is seen.
+func cachedFieldByName(v reflect.Value, name string) reflect.Value {
+	typ := v.Type()
+	fields, ok := fieldCache.Load(typ)
+	if !ok {
+		index := make(map[string][]int)
+		for _, f := range reflect.VisibleFields(typ) {
+			if name, ok := luaName(f); ok && f.IsExported() && promoted(typ, f) {
+				index[name] = f.Index
+			}
+		}
+		fields, _ = fieldCache.LoadOrStore(typ, index)
+	}
+	index, ok := fields.(map[string][]int)[name]
+	if !ok {
+		return reflect.Value{}
+	}
+	return fieldByIndex(v, index)
+}
+
+// fieldByIndex returns the nested field of v at index, allocating nil embedded
+// struct pointers along the way. The zero Value is returned if one can't be
+// allocated.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// setter returns the method Set<Name> of the addressable struct v if it has
+// one taking a single argument, or the zero Value.
+func setter(v reflect.Value, name string) reflect.Value {
+	if !v.CanAddr() {
+		return reflect.Value{}
+	}
+	m := v.Addr().MethodByName("Set" + strings.Title(name))
+	if !m.IsValid() || m.Type().NumIn() != 1 {
+		return reflect.Value{}
+	}
+	return m
+}
+
+// callSetter calls the setter m with arg, returning the error it returns, if
+// any.
+func callSetter(m, arg reflect.Value) error {
+	out := m.Call([]reflect.Value{arg})
+	if len(out) > 0 {
+		if err, ok := out[len(out)-1].Interface().(error); ok {
+			return err
+		}
+	}
 	return nil
 }
 
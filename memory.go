@@ -0,0 +1,86 @@
+package luna
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+// MemoryLimitExceeded is returned when a script fails because Lua couldn't
+// allocate memory without going over the limit set with SetMemoryLimit.
+type MemoryLimitExceeded int
+
+func (n MemoryLimitExceeded) Error() string {
+	return fmt.Sprintf("Memory limit exceeded: %d bytes", int(n))
+}
+
+// SetMemoryLimit limits the memory the Lua state can use to about <bytes>.
+// Allocations that would go over it while a script runs fail, which raises an
+// out of memory error in the script, returned as MemoryLimitExceeded by the
+// Load, Call, etc. that ran it. A limit of 0 removes the limit. Memory already
+// in use is counted, so a limit below MemoryUsage stops the script at its next
+// allocation.
+// Allocations made by Go outside of a script, like pushing the arguments of a
+// Call, are never refused, since an out of memory error there couldn't be
+// caught and would abort the process; they can take the usage past the limit.
+func (l *Luna) SetMemoryLimit(bytes int) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		if !l.tracksMemory {
+			l.memUsed = l.gcCount()
+			l.L.SetAllocf(l.alloc)
+			l.tracksMemory = true
+		}
+		l.memLimit = bytes
+	})
+	return
+}
+
+// MemoryUsage returns the number of bytes the Lua state is using.
+func (l *Luna) MemoryUsage() (n int) {
+	defer l.lock()()
+	if l.ready() != nil {
+		return 0
+	}
+	l.do(func() {
+		if l.tracksMemory {
+			n = l.memUsed
+		} else {
+			n = l.gcCount()
+		}
+	})
+	return
+}
+
+// gcCount returns the memory in use reported by the garbage collector.
+func (l *Luna) gcCount() int {
+	return l.L.GC(lua.LUA_GCCOUNT, 0)*1024 + l.L.GC(lua.LUA_GCCOUNTB, 0)
+}
+
+// alloc is the Lua allocator installed by SetMemoryLimit. It's the same as
+// Lua's default one, except that it refuses to grow past the limit while a
+// protected call is running. Lua expects shrinking to always succeed, so
+// that's never refused.
+func (l *Luna) alloc(ptr unsafe.Pointer, osize, nsize uint) unsafe.Pointer {
+	if nsize == 0 {
+		C.free(ptr)
+		l.memUsed -= int(osize)
+		return nil
+	}
+	if l.memLimit > 0 && nsize > osize && l.active.Load() > 0 && l.memUsed+int(nsize-osize) > l.memLimit {
+		l.memExceeded = true
+		return nil
+	}
+	p := C.realloc(ptr, C.size_t(nsize))
+	if p != nil {
+		l.memUsed += int(nsize) - int(osize)
+	}
+	return p
+}
@@ -0,0 +1,115 @@
+package luna
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+// pushPointer pushes ptr, a non-nil pointer to a struct, as userdata. Reading
+// and writing its fields from Lua goes through reflection to the Go value
+// itself, rather than a copy. Methods, including those with pointer receivers,
+// are bound to the pointer.
+func (l *Luna) pushPointer(ptr reflect.Value) {
+	ud := l.L.NewUserdata(1)
+	l.objects[uintptr(ud)] = ptr
+	l.pushPointerMetatable(ptr.Type())
+	l.L.SetMetaTable(-2)
+}
+
+// object returns the Go pointer of the userdata at index i, if it was pushed
+// by pushPointer.
+func (l *Luna) object(i int) (reflect.Value, bool) {
+	if !l.L.IsUserdata(i) {
+		return reflect.Value{}, false
+	}
+	v, ok := l.objects[uintptr(l.L.ToUserdata(i))]
+	return v, ok
+}
+
+// pushPointerMetatable pushes the metatable for pointers of type typ, which is
+// created once per type and kept in the registry.
+func (l *Luna) pushPointerMetatable(typ reflect.Type) {
+	if ref, ok := l.metatables[typ]; ok {
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+		return
+	}
+
+	l.L.NewTable()
+	l.L.PushGoFunction(func(L *lua.State) int {
+		ptr, ok := l.object(1)
+		if !ok {
+			L.RaiseError("bad self")
+			return 0
+		}
+		name := L.ToString(2)
+		if f := fieldByName(ptr.Elem(), name); f.IsValid() && f.CanInterface() {
+			if err := l.push(f.Interface()); err != nil {
+				L.RaiseError(err.Error())
+			}
+			return 1
+		}
+		if m, ok := typ.MethodByName(name); ok {
+			l.pushMethod(L.ToPointer(1), m.Name, ptr.Method(m.Index))
+			return 1
+		}
+		L.PushNil()
+		return 1
+	})
+	l.L.SetField(-2, "__index")
+	l.L.PushGoFunction(func(L *lua.State) int {
+		ptr, ok := l.object(1)
+		if !ok {
+			L.RaiseError("bad self")
+			return 0
+		}
+		name := L.ToString(2)
+		f := fieldByName(ptr.Elem(), name)
+		if !f.IsValid() || !f.CanSet() {
+			L.RaiseError(fmt.Sprintf("Cannot set field %s of %s", name, typ))
+			return 0
+		}
+		if err := l.set(f, 3); err != nil {
+			L.RaiseError(err.Error())
+		}
+		return 0
+	})
+	l.L.SetField(-2, "__newindex")
+	l.L.PushGoFunction(func(L *lua.State) int {
+		delete(l.objects, uintptr(L.ToUserdata(1)))
+		return 0
+	})
+	l.L.SetField(-2, "__gc")
+
+	l.L.PushValue(-1)
+	l.metatables[typ] = l.L.Ref(lua.LUA_REGISTRYINDEX)
+}
+
+// LuaPointer is a Go pointer that was pushed to Lua and returned to Go.
+type LuaPointer struct {
+	Ptr interface{}
+}
+
+// Unmarshal sets d, a pointer to either a pointer of the same type or the
+// struct it points to, to Ptr or a copy of the struct respectively.
+func (lv LuaPointer) Unmarshal(d interface{}) error {
+	destVal := reflect.ValueOf(d)
+	if destVal.Type().Kind() != reflect.Ptr {
+		return fmt.Errorf("Must pass a pointer type to Unmarshal")
+	}
+	ptr := reflect.ValueOf(lv.Ptr)
+	switch dest := destVal.Elem(); {
+	case ptr.Type().AssignableTo(dest.Type()):
+		dest.Set(ptr)
+	case ptr.Type().Elem().AssignableTo(dest.Type()):
+		dest.Set(ptr.Elem())
+	default:
+		return fmt.Errorf("Cannot assign '%s' to '%s'", ptr.Type(), dest.Type())
+	}
+	return nil
+}
+
+func (lv LuaPointer) String() string {
+	return fmt.Sprint(lv.Ptr)
+}
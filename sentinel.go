@@ -0,0 +1,98 @@
+package luna
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// RegisterErrors makes errs, typically sentinel errors like io.EOF, push to
+// Lua as userdata that's created once per error. Every push of the same error
+// gives the same Lua value, so scripts can compare them with ==. tostring()
+// gives the error's message. Registered errors passed back to Go are converted
+// to the original error.
+func (l *Luna) RegisterErrors(errs ...error) (err error) {
+	for _, e := range errs {
+		if e == nil || !reflect.TypeOf(e).Comparable() {
+			return fmt.Errorf("Error can't be registered: %v", e)
+		}
+	}
+
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		for _, e := range errs {
+			if _, ok := l.errorRefs[e]; ok {
+				continue
+			}
+			l.L.NewUserdata(1)
+			l.L.NewTable()
+			msg := e.Error()
+			l.L.PushGoFunction(func(L *lua.State) int {
+				L.PushString(msg)
+				return 1
+			})
+			l.L.SetField(-2, "__tostring")
+			l.L.SetMetaTable(-2)
+			l.errorRefs[e] = l.L.Ref(lua.LUA_REGISTRYINDEX)
+		}
+	})
+	return
+}
+
+// pushError pushes the userdata of err if it was registered with
+// RegisterErrors, returning false if it wasn't.
+func (l *Luna) pushError(err error) bool {
+	if !reflect.TypeOf(err).Comparable() {
+		return false
+	}
+	ref, ok := l.errorRefs[err]
+	if !ok {
+		return false
+	}
+	l.L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+	return true
+}
+
+// toError returns the registered error whose userdata is at index i.
+func (l *Luna) toError(i int) (error, bool) {
+	if i < 0 {
+		i = l.L.GetTop() + i + 1
+	}
+	for e, ref := range l.errorRefs {
+		l.L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+		equal := l.L.RawEqual(i, -1)
+		l.L.Pop(1)
+		if equal {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// LuaError is a registered error (see RegisterErrors) returned from Lua.
+type LuaError struct {
+	Err error
+}
+
+func (lv LuaError) Unmarshal(d interface{}) error {
+	destVal := reflect.ValueOf(d)
+	if destVal.Type().Kind() != reflect.Ptr {
+		return fmt.Errorf("Must pass a pointer type to Unmarshal")
+	}
+	errVal := reflect.ValueOf(lv.Err)
+	if !errVal.Type().AssignableTo(destVal.Elem().Type()) {
+		return fmt.Errorf("Cannot assign '%s' to '%s'", errVal.Type(), destVal.Elem().Type())
+	}
+	destVal.Elem().Set(errVal)
+	return nil
+}
+
+func (lv LuaError) String() string {
+	return lv.Err.Error()
+}
@@ -0,0 +1,192 @@
+package luna
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+// Stream is a file-like Lua object backed by a Go io.Reader or io.Writer, so
+// scripts can process data without the io library or access to files. Like a
+// Lua file, a reader has the methods stream:read(...) and stream:lines(), and
+// a writer has stream:write(...).
+// A Stream can be passed to Lua like any other value, e.g. as an argument to
+// Call. The Lua object is kept until Release is called or the Stream is
+// garbage collected by Go.
+type Stream struct {
+	l   *Luna
+	ref int
+}
+
+// newStream wraps ref, a reference to the Lua object of a stream, releasing it
+// once the Stream is garbage collected, like newFunction.
+func (l *Luna) newStream(ref int) *Stream {
+	s := &Stream{l: l, ref: ref}
+	runtime.SetFinalizer(s, (*Stream).finalize)
+	return s
+}
+
+// finalize queues s's reference to be released by the worker.
+func (s *Stream) finalize() {
+	if s.ref != 0 {
+		s.l.queueUnref(s.ref)
+	}
+}
+
+// Release drops the reference to the stream's Lua object, after which the
+// Stream can't be passed to Lua. Scripts still holding the object can keep
+// using it.
+func (s *Stream) Release() {
+	l := s.l
+	defer l.lock()()
+	if l.ready() != nil || s.ref == 0 {
+		return
+	}
+	l.do(func() { l.L.Unref(lua.LUA_REGISTRYINDEX, s.ref) })
+	s.ref = 0
+	runtime.SetFinalizer(s, nil)
+}
+
+// PushReader creates a Stream that reads from r. read() supports the formats
+// "*l" (the default), "*a", "*n" and a number of bytes.
+func (l *Luna) PushReader(r io.Reader) (s *Stream, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	br := bufio.NewReader(r)
+	l.do(func() {
+		read := func(L *lua.State) int {
+			return readFormats(L, br)
+		}
+		l.L.NewTable()
+		l.L.PushGoFunction(read)
+		l.L.SetField(-2, "read")
+		l.L.PushGoFunction(func(L *lua.State) int {
+			L.PushGoFunction(func(L *lua.State) int {
+				// read a line, ignoring the arguments of the for loop
+				L.SetTop(1)
+				return read(L)
+			})
+			return 1
+		})
+		l.L.SetField(-2, "lines")
+		s = l.newStream(l.L.Ref(lua.LUA_REGISTRYINDEX))
+	})
+	return
+}
+
+// PushWriter creates a Stream that writes to w. write() takes any number of
+// strings or numbers and returns the stream, so calls can be chained.
+func (l *Luna) PushWriter(w io.Writer) (s *Stream, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		l.L.NewTable()
+		l.L.PushGoFunction(func(L *lua.State) int {
+			for i := 2; i <= L.GetTop(); i++ {
+				if !L.IsString(i) {
+					L.RaiseError(fmt.Sprintf("bad argument #%d to 'write' (string expected, got %s)", i-1, L.Typename(int(L.Type(i)))))
+					return 0
+				}
+				if _, err := io.WriteString(w, L.ToString(i)); err != nil {
+					L.RaiseError(err.Error())
+					return 0
+				}
+			}
+			L.PushValue(1)
+			return 1
+		})
+		l.L.SetField(-2, "write")
+		s = l.newStream(l.L.Ref(lua.LUA_REGISTRYINDEX))
+	})
+	return
+}
+
+// readFormats implements read() for the formats given after the stream at
+// index 1, pushing a result for each until one hits the end of the input.
+func readFormats(L *lua.State, r *bufio.Reader) int {
+	n := L.GetTop()
+	if n < 2 {
+		L.PushString("*l")
+		n++
+	}
+	for i := 2; i <= n; i++ {
+		var ok bool
+		var err error
+		if L.Type(i) == lua.LUA_TNUMBER {
+			ok, err = readBytes(L, r, int(L.ToNumber(i)))
+		} else {
+			format := L.ToString(i)
+			switch f := strings.TrimPrefix(format, "*"); {
+			case strings.HasPrefix(f, "l"):
+				ok, err = readLine(L, r)
+			case strings.HasPrefix(f, "a"):
+				var b []byte
+				b, err = io.ReadAll(r)
+				L.PushString(string(b))
+				ok = true
+			case strings.HasPrefix(f, "n"):
+				var f float64
+				if _, e := fmt.Fscan(r, &f); e == nil {
+					L.PushNumber(f)
+					ok = true
+				}
+			default:
+				L.RaiseError(fmt.Sprintf("bad argument #%d to 'read' (invalid format %s)", i-1, format))
+				return 0
+			}
+		}
+		if err != nil {
+			L.RaiseError(err.Error())
+			return 0
+		}
+		if !ok {
+			L.PushNil()
+			return i - 1
+		}
+	}
+	return n - 1
+}
+
+// readLine pushes the next line without its newline, returning false at the
+// end of the input.
+func readLine(L *lua.State, r *bufio.Reader) (bool, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF {
+		if line == "" {
+			return false, nil
+		}
+		err = nil
+	}
+	L.PushString(strings.TrimSuffix(line, "\n"))
+	return true, err
+}
+
+// readBytes pushes up to n bytes, returning false at the end of the input.
+func readBytes(L *lua.State, r *bufio.Reader, n int) (bool, error) {
+	if n <= 0 {
+		// like Lua, test for the end of the input
+		if _, err := r.Peek(1); err != nil {
+			return false, nil
+		}
+		L.PushString("")
+		return true, nil
+	}
+	b := make([]byte, n)
+	k, err := io.ReadFull(r, b)
+	if k == 0 {
+		return false, nil
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	L.PushString(string(b[:k]))
+	return true, err
+}
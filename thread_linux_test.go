@@ -0,0 +1,54 @@
+package luna
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+func TestSingleThread(t *testing.T) {
+	var mut sync.Mutex
+	tids := make(map[int]bool)
+	record := func() {
+		mut.Lock()
+		tids[syscall.Gettid()] = true
+		mut.Unlock()
+	}
+
+	l := New(LibBase)
+	defer l.Close()
+
+	if err := l.CreateLibrary("testlib", TableKeyValue{"record", record}); err != nil {
+		t.Fatal("Error creating library:", err)
+	}
+	if _, err := l.Load("testlib.record() function callMe() testlib.record() end"); err != nil {
+		t.Fatal("Error loading test code:", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := l.Call("callMe"); err != nil {
+				t.Error("Error calling 'callMe':", err)
+			}
+			if _, err := l.CallContext(context.Background(), "callMe"); err != nil {
+				t.Error("Error calling 'callMe' with a context:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	l.WithState(func(*lua.State) error {
+		record()
+		return nil
+	})
+
+	if len(tids) != 1 {
+		t.Errorf("Expected all Lua access on one thread, got %d threads", len(tids))
+	}
+}
@@ -0,0 +1,110 @@
+package luna
+
+import (
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// TimeEncoding controls how time.Time values are pushed to Lua.
+type TimeEncoding int
+
+const (
+	// UnixTime pushes times as seconds since the Unix epoch, like os.time(),
+	// with any fraction of a second after the decimal point
+	UnixTime TimeEncoding = iota
+	// RFC3339Time pushes times as strings like "2006-01-02T15:04:05Z07:00",
+	// with fractional seconds if there are any
+	RFC3339Time
+)
+
+// DurationEncoding controls how time.Duration values are pushed to Lua, and
+// how Lua numbers are converted back to them. The default is nanoseconds.
+type DurationEncoding int
+
+const (
+	// DurationNanoseconds pushes durations as a number of nanoseconds, like
+	// their Go value
+	DurationNanoseconds DurationEncoding = iota
+	// DurationSeconds pushes durations as a number of seconds, like the
+	// differences between os.time() or os.clock() values
+	DurationSeconds
+)
+
+// pushTime pushes t according to l.TimeEncoding.
+func (l *Luna) pushTime(t time.Time) {
+	if l.TimeEncoding == RFC3339Time {
+		l.L.PushString(t.Format(time.RFC3339Nano))
+		return
+	}
+	l.L.PushNumber(float64(t.UnixNano()) / float64(time.Second))
+}
+
+// pushDuration pushes d according to l.DurationEncoding.
+func (l *Luna) pushDuration(d time.Duration) {
+	if l.DurationEncoding == DurationNanoseconds {
+		l.pushInteger(int64(d))
+		return
+	}
+	l.L.PushNumber(d.Seconds())
+}
+
+// setTime sets val, a time.Time or time.Duration, to the value at index i.
+// Times can be given as a number of seconds since the Unix epoch or an RFC 3339
+// string, and durations as a number in the unit of l.DurationEncoding or a
+// string like "1m30s", whatever the encoding used to push them.
+func (l *Luna) setTime(val reflect.Value, i int) error {
+	switch t := l.L.Type(i); t {
+	case lua.LUA_TNUMBER:
+		return setTimeValue(val, LuaNumber(l.L.ToNumber(i)), l.DurationEncoding)
+	case lua.LUA_TSTRING:
+		return setTimeValue(val, LuaString(l.L.ToString(i)), l.DurationEncoding)
+	case lua.LUA_TNIL:
+		val.Set(reflect.Zero(val.Type()))
+		return nil
+	default:
+		return &TypeError{LuaType: l.L.Typename(int(t)), GoType: val.Type()}
+	}
+}
+
+// setTimeValue sets val, a time.Time or time.Duration, to src, a LuaNumber or
+// LuaString, like setTime. Numbers are converted to durations according to
+// enc.
+func setTimeValue(val reflect.Value, src LuaValue, enc DurationEncoding) error {
+	typ := val.Type()
+	switch v := src.(type) {
+	case LuaNumber:
+		if typ == timeType {
+			sec, frac := math.Modf(float64(v))
+			val.Set(reflect.ValueOf(time.Unix(int64(sec), int64(frac*float64(time.Second)))))
+			return nil
+		}
+		n := float64(v)
+		if enc == DurationSeconds {
+			n *= float64(time.Second)
+		}
+		val.SetInt(int64(math.Round(n)))
+	case LuaString:
+		if typ == timeType {
+			tm, err := time.Parse(time.RFC3339Nano, string(v))
+			if err != nil {
+				return err
+			}
+			val.Set(reflect.ValueOf(tm))
+			return nil
+		}
+		d, err := time.ParseDuration(string(v))
+		if err != nil {
+			return err
+		}
+		val.SetInt(int64(d))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package luna
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/beatgammit/golua/lua"
+)
+
+// LunaError is an error raised by Lua code run with Call, Load, etc. Errors
+// raised with a position, like runtime errors and error("msg"), are split into
+// their Source, Line and Message. If LibDebug and LibBase are open, and no
+// handler was set with SetMessageHandler, Traceback holds the stack traceback
+// from debug.traceback() where the error was raised.
+type LunaError struct {
+	Message   string
+	Source    string
+	Line      int
+	Traceback string
+}
+
+// Error returns the error like Lua reports it, without the traceback.
+func (e *LunaError) Error() string {
+	if e.Source == "" {
+		return e.Message
+	}
+	return e.Source + ":" + strconv.Itoa(e.Line) + ": " + e.Message
+}
+
+// errorPosition matches the position Lua adds to error messages, like
+// "myscript.lua:42: " or `[string "x = 1"]:1: `.
+var errorPosition = regexp.MustCompile(`^(\[string ".*?"\]|[^\s:][^:\n]*):(\d+): `)
+
+// newLunaError parses msg, an error message from Lua, which may end with a
+// traceback added by debug.traceback().
+func newLunaError(msg string) *LunaError {
+	e := &LunaError{Message: msg}
+	if i := strings.LastIndex(msg, "\nstack traceback:\n"); i >= 0 {
+		e.Message, e.Traceback = msg[:i], msg[i+1:]
+	}
+	if m := errorPosition.FindStringSubmatch(e.Message); m != nil {
+		e.Source = m[1]
+		e.Line, _ = strconv.Atoi(m[2])
+		e.Message = e.Message[len(m[0]):]
+	}
+	return e
+}
+
+// luaError converts the error returned by running Lua code to a *LunaError.
+func luaError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *LunaError
+	if errors.As(err, &e) {
+		return err
+	}
+	return newLunaError(err.Error())
+}
+
+// openTraceback makes debug.traceback() the message handler used while no other
+// handler is set. It must be called after the libraries are opened.
+func (l *Luna) openTraceback() error {
+	if l.lib&LibDebug == 0 || l.lib&LibBase == 0 {
+		return nil
+	}
+	if err := l.loadTrampoline(); err != nil {
+		return err
+	}
+	l.L.GetGlobal("debug")
+	l.L.GetField(-1, "traceback")
+	l.traceback = l.L.Ref(lua.LUA_REGISTRYINDEX)
+	l.L.Pop(1)
+	return nil
+}
+
+// loadTrampoline loads trampolineSrc, which pcall uses to run code with a
+// message handler, if it isn't loaded yet.
+func (l *Luna) loadTrampoline() error {
+	if l.trampoline != 0 {
+		return nil
+	}
+	// the trampoline captures these, so it would fail on every call without
+	for _, name := range []string{"xpcall", "unpack", "select", "error"} {
+		l.L.GetGlobal(name)
+		ok := l.L.IsFunction(-1)
+		l.L.Pop(1)
+		if !ok {
+			return fmt.Errorf("Message handlers require LibBase: %s is missing", name)
+		}
+	}
+	if l.L.LoadString(trampolineSrc) != 0 {
+		err := errors.New(l.L.ToString(-1))
+		l.L.Pop(1)
+		return err
+	}
+	if err := l.L.Call(0, 1); err != nil {
+		return err
+	}
+	l.trampoline = l.L.Ref(lua.LUA_REGISTRYINDEX)
+	return nil
+}
@@ -0,0 +1,75 @@
+package luna
+
+import (
+	"fmt"
+)
+
+// GetUpvalue returns the value of the nth (1-based) upvalue of the global
+// function <fnName>. This requires LibDebug.
+func (l *Luna) GetUpvalue(fnName string, n int) (val LuaValue, err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+
+		if err = l.pushUpvalueCall("getupvalue", fnName, n); err != nil {
+			return
+		}
+		if err = l.L.Call(2, 2); err != nil {
+			return
+		}
+		if l.L.IsNil(-2) {
+			err = fmt.Errorf("Invalid upvalue index for %s: %d", fnName, n)
+			return
+		}
+		val, err = l.pop(l.L.GetTop())
+	})
+	return
+}
+
+// SetUpvalue sets the nth (1-based) upvalue of the global function <fnName>
+// to v. This requires LibDebug.
+func (l *Luna) SetUpvalue(fnName string, n int, v interface{}) (err error) {
+	defer l.lock()()
+	if err = l.ready(); err != nil {
+		return
+	}
+	l.do(func() {
+		top := l.L.GetTop()
+		defer l.L.SetTop(top)
+
+		if err = l.pushUpvalueCall("setupvalue", fnName, n); err != nil {
+			return
+		}
+		if err = l.push(v); err != nil {
+			return
+		}
+		if err = l.L.Call(3, 1); err != nil {
+			return
+		}
+		if l.L.IsNil(-1) {
+			err = fmt.Errorf("Invalid upvalue index for %s: %d", fnName, n)
+		}
+	})
+	return
+}
+
+// pushUpvalueCall pushes debug.<name>, the function <fnName> and n.
+func (l *Luna) pushUpvalueCall(name, fnName string, n int) error {
+	l.L.GetGlobal("debug")
+	if !l.L.IsTable(-1) {
+		return fmt.Errorf("Debug library not loaded")
+	}
+	l.L.GetField(-1, name)
+	l.L.Remove(-2)
+
+	l.L.GetGlobal(fnName)
+	if !l.L.IsFunction(-1) {
+		return fmt.Errorf("Not a function: %s", fnName)
+	}
+	l.L.PushInteger(int64(n))
+	return nil
+}
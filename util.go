@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"runtime"
+	"strings"
 
 	"github.com/beatgammit/golua/lua"
 )
@@ -11,28 +13,117 @@ import (
 // helper functions
 
 // printGen generates a print() function that writes to the given io.Writer.
-func printGen(w io.Writer) func(...string) {
-	return func(args ...string) {
-		// TODO: support interface{} parameters
-		var _args []interface{}
-		for _, arg := range args {
-			_args = append(_args, arg)
+// Like Lua's print(), it converts its arguments with tostring() and separates
+// them with tabs.
+func printGen(w io.Writer) lua.LuaGoFunction {
+	return func(L *lua.State) int {
+		n := L.GetTop()
+		args := make([]string, n)
+		for i := 1; i <= n; i++ {
+			L.GetGlobal("tostring")
+			if !L.IsFunction(-1) {
+				// the base library isn't open
+				L.Pop(1)
+				args[i-1] = basicToString(L, i)
+				continue
+			}
+			L.PushValue(i)
+			if err := L.Call(1, 1); err != nil {
+				L.RaiseError(err.Error())
+				return 0
+			}
+			args[i-1] = L.ToString(-1)
+			L.Pop(1)
 		}
-		fmt.Fprintln(w, _args...)
+		fmt.Fprintln(w, strings.Join(args, "\t"))
+		return 0
+	}
+}
+
+// Tostring formats lv like Lua's tostring() does: numbers with up to 14
+// significant digits, booleans as true or false, and nil as nil. A table
+// returned to Go no longer has an address to print, so it's formatted by
+// LuaTable.String instead.
+func Tostring(lv LuaValue) string {
+	if s, ok := lv.(fmt.Stringer); ok {
+		return s.String()
+	}
+	if lv == nil {
+		return "nil"
+	}
+	return fmt.Sprint(lv)
+}
+
+// basicToString is a stand-in for tostring() that formats numbers, strings,
+// booleans and nil the same way, and other values as their type name.
+func basicToString(L *lua.State, i int) string {
+	switch L.Type(i) {
+	case lua.LUA_TNUMBER:
+		return LuaNumber(L.ToNumber(i)).String()
+	case lua.LUA_TSTRING:
+		return L.ToString(i)
+	case lua.LUA_TBOOLEAN:
+		return LuaBool(L.ToBoolean(i)).String()
+	case lua.LUA_TNIL:
+		return "nil"
+	}
+	return L.Typename(int(L.Type(i)))
+}
+
+// funcName returns <name>, or if it's empty, the name of the Go function fn,
+// like "pkg.Func", for error messages about functions that weren't registered
+// under a name.
+func funcName(name string, fn reflect.Value) string {
+	if name != "" {
+		return name
+	}
+	f := runtime.FuncForPC(fn.Pointer())
+	if f == nil {
+		return "Go function"
 	}
+	name = f.Name()
+	return name[strings.LastIndex(name, "/")+1:]
 }
 
-func wrapperGen(l *Luna, impl reflect.Value) lua.LuaGoFunction {
+// wrapperGen wraps impl as a Lua function, converting its arguments from Lua
+// and its results back. <name> is used in error messages; if it's empty, the
+// Go name of impl is used.
+func wrapperGen(l *Luna, name string, impl reflect.Value, opts FuncOptions) lua.LuaGoFunction {
 	typ := impl.Type()
-	params := make([]reflect.Value, typ.NumIn())
+	translate := opts.Returns == TranslateErrors && typ.NumOut() > 0 && typ.Out(typ.NumOut()-1) == errorType
+
+	// a final Varargs parameter gets all of the remaining arguments, and like
+	// a variadic one, doesn't need any
+	required := typ.NumIn()
+	capture := !typ.IsVariadic() && required > 0 && typ.In(required-1) == varargsType
+	if capture || typ.IsVariadic() {
+		required--
+	}
 
 	return func(L *lua.State) int {
+		// allocated per call, since the function can be called again, through
+		// Lua, before this call returns
+		params := make([]reflect.Value, typ.NumIn())
 		for i := range params {
 			params[i] = reflect.New(typ.In(i)).Elem()
 		}
 		args := L.GetTop()
-		if args < len(params) {
-			panic(fmt.Sprintf("Args: %d, Params: %d", args, len(params)))
+		if args < required {
+			L.RaiseError(fmt.Sprintf("Not enough arguments to '%s': expected %d, got %d", funcName(name, impl), required, args))
+			return 0
+		}
+		if capture {
+			var rest Varargs
+			for i := required + 1; i <= args; i++ {
+				val, err := l.pop(i)
+				if err != nil {
+					L.RaiseError(fmt.Sprintf("bad argument #%d to '%s' (%v)", i, funcName(name, impl), err))
+					return 0
+				}
+				rest = append(rest, val)
+			}
+			params[required] = reflect.ValueOf(rest)
+			args = required
 		}
 
 		var varargs reflect.Value
@@ -44,14 +135,18 @@ func wrapperGen(l *Luna, impl reflect.Value) lua.LuaGoFunction {
 		for i := 1; i <= args; i++ {
 			if i >= len(params) && typ.IsVariadic() {
 				val := reflect.New(varargs.Type().Elem()).Elem()
-				l.set(val, i)
+				if err := l.set(val, i); err != nil {
+					L.RaiseError(fmt.Sprintf("bad argument #%d to '%s' (%v)", i, funcName(name, impl), err))
+					return 0
+				}
 				varargs = reflect.Append(varargs, val)
 			} else if i > len(params) {
 				// ignore extra args
 				break
 			} else {
 				if err := l.set(params[i-1], i); err != nil {
-					panic(err)
+					L.RaiseError(fmt.Sprintf("bad argument #%d to '%s' (%v)", i, funcName(name, impl), err))
+					return 0
 				}
 			}
 		}
@@ -63,12 +158,32 @@ func wrapperGen(l *Luna, impl reflect.Value) lua.LuaGoFunction {
 		} else {
 			ret = impl.Call(params)
 		}
+		if translate {
+			last := ret[len(ret)-1]
+			if !last.IsNil() {
+				L.RaiseError(last.Interface().(error).Error())
+				return 0
+			}
+			ret = ret[:len(ret)-1]
+		}
+		if n := len(ret); opts.Spread && n > 0 && (ret[n-1].Kind() == reflect.Slice || ret[n-1].Kind() == reflect.Array) {
+			last := ret[n-1]
+			ret = ret[:n-1]
+			for i := 0; i < last.Len(); i++ {
+				ret = append(ret, last.Index(i))
+			}
+			if !L.CheckStack(len(ret)) {
+				L.RaiseError("Too many results to spread")
+				return 0
+			}
+		}
 		for _, val := range ret {
 			if l.pushBasicType(val.Interface()) {
 				continue
 			}
 			if err := l.pushComplexType(val.Interface()); err != nil {
-				panic(err)
+				L.RaiseError(fmt.Sprintf("Cannot return from '%s': %v", funcName(name, impl), err))
+				return 0
 			}
 		}
 		return len(ret)
@@ -0,0 +1,131 @@
+package luna
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// register records fn, if it's a function, as registered under <name>.
+func (l *Luna) register(name string, fn interface{}) {
+	if typ := reflect.TypeOf(fn); typ != nil && typ.Kind() == reflect.Func {
+		l.registered[name] = typ
+	}
+}
+
+// ValidateRegistrations checks that the parameters and results of every Go
+// function registered with CreateLibrary, RegisterFuncWith, etc. are of types
+// that can be converted from and to Lua, so mistakes are found at startup
+// instead of when a function is first called. All of the problems found are
+// returned together.
+func (l *Luna) ValidateRegistrations() error {
+	defer l.lock()()
+	if err := l.ready(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(l.registered))
+	for name := range l.registered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		typ := l.registered[name]
+		for i := 0; i < typ.NumIn(); i++ {
+			in := typ.In(i)
+			last := i == typ.NumIn()-1
+			if last && typ.IsVariadic() {
+				in = in.Elem()
+			}
+			if last && in == varargsType {
+				continue
+			}
+			if !settable(in) {
+				errs = append(errs, fmt.Errorf("%s: unsupported parameter %d of type %s", name, i+1, typ.In(i)))
+			}
+		}
+		for i := 0; i < typ.NumOut(); i++ {
+			if !pushable(typ.Out(i), make(map[reflect.Type]bool)) {
+				errs = append(errs, fmt.Errorf("%s: unsupported result %d of type %s", name, i+1, typ.Out(i)))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// settable reports whether set can assign Lua values to a Go value of type typ.
+func settable(typ reflect.Type) bool {
+	switch typ {
+	case luaValueType, luaFunctionType, timeType, durationType:
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.Bool, reflect.String, reflect.Struct,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return typ.Elem().Kind() == reflect.Uint8
+	case reflect.Map:
+		return settable(typ.Key()) && settable(typ.Elem())
+	case reflect.Ptr:
+		return settable(typ.Elem())
+	case reflect.Interface:
+		// registered errors
+		return typ == errorType
+	}
+	return false
+}
+
+var (
+	marshalerType = reflect.TypeOf((*LuaMarshaler)(nil)).Elem()
+	arrayerType   = reflect.TypeOf((*LuaArrayer)(nil)).Elem()
+)
+
+// pushable reports whether values of type typ can be pushed to Lua. Types in
+// seen are assumed to be, which stops recursive types from looping.
+func pushable(typ reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[typ] || typ.Implements(marshalerType) || typ.Implements(arrayerType) {
+		return true
+	}
+	seen[typ] = true
+
+	switch typ.Kind() {
+	case reflect.Bool, reflect.String, reflect.Func, reflect.Interface,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice, reflect.Array, reflect.Ptr:
+		return pushable(typ.Elem(), seen)
+	case reflect.Map:
+		// see pushKey
+		switch typ.Key().Kind() {
+		case reflect.Bool, reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return pushable(typ.Elem(), seen)
+		}
+		return false
+	case reflect.Struct:
+		if typ == timeType {
+			return true
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if _, ok := luaName(f); !ok || !f.IsExported() {
+				continue
+			}
+			if !pushable(f.Type, seen) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}